@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+)
+
+type AlertRequest struct {
+	CardID *uuid.UUID `json:"card_id"`
+	OracleID *uuid.UUID `json:"oracle_id"`
+	// Defaults to nonfoil
+	Finish string `json:"finish"`
+	// Defaults to usd
+	Currency string `json:"currency"`
+	Direction string `json:"direction"`
+	Threshold *float64 `json:"threshold"`
+	PercentChange *float64 `json:"percent_change"`
+}
+
+type NotificationsResult struct {
+	PagedResult
+	Notifications []models.Notification `json:"results"`
+}
+
+type ReadNotificationsRequest struct {
+	// Marks every notification as read when empty
+	IDs []uint `json:"ids"`
+}
+
+// Checks an AlertRequest makes sense and turns it into a rule for userID
+func (request AlertRequest) rule(userID uint) (models.AlertRule, error) {
+	if (request.CardID == nil) == (request.OracleID == nil) {
+		return models.AlertRule{}, ErrInvalidAlertCard
+	}
+	if (request.Threshold == nil) == (request.PercentChange == nil) ||
+	   (request.Threshold != nil && *request.Threshold <= 0) ||
+	   (request.PercentChange != nil && *request.PercentChange <= 0) {
+		return models.AlertRule{}, ErrInvalidAlertPrice
+	}
+
+	rule := models.AlertRule{
+		UserID: userID,
+		CardID: request.CardID,
+		OracleID: request.OracleID,
+		Finish: request.Finish,
+		Currency: strings.ToLower(request.Currency),
+		Direction: strings.ToLower(request.Direction),
+		Threshold: request.Threshold,
+		PercentChange: request.PercentChange,
+	}
+
+	if rule.Finish == "" {
+		rule.Finish = models.FinishNonfoil
+	} else if !models.IsFinish(rule.Finish) {
+		return models.AlertRule{}, ErrUnknownFinish
+	}
+	if rule.Currency == "" {
+		rule.Currency = models.CurrencyUSD
+	} else if !models.IsCurrency(rule.Currency) {
+		return models.AlertRule{}, ErrUnknownCurrency
+	}
+	if rule.Direction != models.DirectionAbove && rule.Direction != models.DirectionBelow {
+		return models.AlertRule{}, ErrUnknownDirection
+	}
+
+	return rule, nil
+}
+
+func alertsEndpoint(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	rules := []models.AlertRule{}
+	err = db.Model(&models.AlertRule{}).
+	         Where("user_id = ?", user.ID).
+	         Order("id").
+	         Find(&rules).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding alerts: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+// Creates an alert rule, the importer checks it every time it refreshes prices
+func createAlertEndpoint(c *gin.Context) {
+	var request AlertRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	rule, err := request.rule(user.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	// Make sure whatever they're watching actually exists
+	var count int64
+	if rule.CardID != nil {
+		err = db.Model(&models.Card{}).Where("id = ?", *rule.CardID).Count(&count).Error
+	} else {
+		err = db.Model(&models.OracleCard{}).Where("id = ?", *rule.OracleID).Count(&count).Error
+	}
+	if err != nil {
+		log.Printf("Got unexpected error finding card: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrCardNotFound.Error()})
+		return
+	}
+
+	err = db.Create(&rule).Error
+	if err != nil {
+		log.Printf("Got unexpected error creating alert: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+func deleteAlertEndpoint(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrAlertNotFound.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	// Scoping the delete to the user stops people deleting each other's alerts
+	result := db.Where("id = ?", id).
+	             Where("user_id = ?", user.ID).
+	             Delete(&models.AlertRule{})
+	if result.Error != nil {
+		log.Printf("Got unexpected error deleting alert: \"%s\"\n", result.Error.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrAlertNotFound.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// The notifications created by a user's alerts, newest first
+func notificationsEndpoint(c *gin.Context) {
+	unread := c.Query("unread") == "true"
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	userNotifications := func(db *gorm.DB) *gorm.DB {
+		result := db.Model(&models.Notification{}).
+		             Where("user_id = ?", user.ID)
+		if unread {
+			result = result.Where("read = false")
+		}
+		return result
+	}
+
+	var count int64
+	err = db.Scopes(userNotifications).
+	         Count(&count).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error counting notifications: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	notifications := []models.Notification{}
+	err = db.Scopes(userNotifications).
+	         Order("created_at desc").
+	         Order("id desc").
+	         Scopes(Paginate(c)).
+	         Find(&notifications).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding notifications: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	offset, exists := c.Get("offset")
+	if !exists {
+		log.Fatal(errors.New("Couldn't find offset in context"))
+	}
+
+	c.JSON(http.StatusOK, NotificationsResult{
+		PagedResult: NewPagedResult(count, offset.(int64)),
+		Notifications: notifications,
+	})
+}
+
+func readNotificationsEndpoint(c *gin.Context) {
+	var request ReadNotificationsRequest
+	// An empty body just means all of them
+	if c.Request.ContentLength != 0 {
+		err := c.ShouldBindJSON(&request)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+			return
+		}
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	result := db.Model(&models.Notification{}).
+	             Where("user_id = ?", user.ID).
+	             Where("read = false")
+	if len(request.IDs) > 0 {
+		result = result.Where("id IN ?", request.IDs)
+	}
+	err = result.Update("read", true).Error
+	if err != nil {
+		log.Printf("Got unexpected error reading notifications: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
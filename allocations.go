@@ -0,0 +1,474 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type AllocationRequest struct {
+	// Which copies to claim for the deck. Only the card, finish, condition
+	// and location are used to find the entry, the quantity is how many
+	// of its copies the deck gets, replacing any it had. 0 gives them all back.
+	Entries []UpdateRequest `json:"entries"`
+}
+
+type AllocationResult struct {
+	Allocations []models.DeckAllocation `json:"allocations"`
+	Errors []BatchError `json:"errors"`
+}
+
+// How many copies a deck has claimed or needs
+type DeckClaim struct {
+	DeckID uint `json:"deck_id"`
+	Deck string `json:"deck"`
+	Quantity int `json:"quantity"`
+}
+
+// A collection entry along with how many of its copies decks have claimed
+type EntryAllocation struct {
+	models.CollectionEntry
+	Allocated int `json:"allocated"`
+	// What's left over, negative when it's over-allocated
+	Free int `json:"free" gorm:"-"`
+	Decks []DeckClaim `json:"decks,omitempty" gorm:"-"`
+}
+
+// A card the user's decks need more copies of, between them, than they own
+type Shortage struct {
+	OracleID uuid.UUID `json:"oracle_id"`
+	Name string `json:"name"`
+	Owned int `json:"owned"`
+	Needed int `json:"needed"`
+	Decks []DeckClaim `json:"decks"`
+}
+
+type AllocationReport struct {
+	// Entries decks have claimed more copies of than there are
+	OverAllocated []EntryAllocation `json:"over_allocated"`
+	Short []Shortage `json:"short"`
+}
+
+// A deck's claim on copies that a move or trade takes away
+type AffectedAllocation struct {
+	AllocationID uint `json:"-"`
+	DeckID uint `json:"deck_id"`
+	Deck string `json:"deck"`
+	CardID uuid.UUID `json:"card_id"`
+	Finish string `json:"finish"`
+	Condition string `json:"condition"`
+	LocationID uint `json:"location_id"`
+	// How many copies the deck had claimed and how many of those are taken
+	Claimed int `json:"claimed"`
+	Taken int `json:"taken"`
+}
+
+// The claims decks have on collectionEntry that there won't be enough
+// copies for once only left are left. Free copies are taken before
+// claimed ones, then the newest claims give theirs up first.
+// With lock the claims are locked so they can be released or moved.
+func excessClaims(tx *gorm.DB, collectionEntry *models.CollectionEntry, left int, lock bool) ([]AffectedAllocation, error) {
+	query := tx.Model(&models.DeckAllocation{})
+	if lock {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "deck_allocations"}})
+	}
+
+	var claims []AffectedAllocation
+	err := query.Select("deck_allocations.id AS allocation_id, decks.id AS deck_id, decks.name AS deck, " +
+	                    "collection_entries.card_id, collection_entries.finish, collection_entries.condition, " +
+	                    "collection_entries.location_id, deck_allocations.quantity AS claimed").
+	             Joins("JOIN decks ON decks.id = deck_allocations.deck_id").
+	             Joins("JOIN collection_entries ON collection_entries.id = deck_allocations.collection_entry_id").
+	             Where("deck_allocations.collection_entry_id IN (?)", tx.Model(&models.CollectionEntry{}).
+	                                                                     Select("id").
+	                                                                     Scopes(sameEntry(collectionEntry))).
+	             Order("deck_allocations.id desc").
+	             Scan(&claims).
+	             Error
+	if err != nil {
+		return nil, err
+	}
+
+	excess := -max(left, 0)
+	for _, claim := range claims {
+		excess += claim.Claimed
+	}
+
+	affected := []AffectedAllocation{}
+	for _, claim := range claims {
+		if excess <= 0 {
+			break
+		}
+		claim.Taken = min(claim.Claimed, excess)
+		excess -= claim.Taken
+		affected = append(affected, claim)
+	}
+	return affected, nil
+}
+
+// Takes the copies in affected away from their claims,
+// claims that are left with none are deleted
+func releaseClaims(tx *gorm.DB, affected []AffectedAllocation) error {
+	for _, claim := range affected {
+		var err error
+		if claim.Taken >= claim.Claimed {
+			err = tx.Unscoped().
+			         Delete(&models.DeckAllocation{}, claim.AllocationID).
+			         Error
+		} else {
+			err = tx.Model(&models.DeckAllocation{}).
+			         Where("id = ?", claim.AllocationID).
+			         Update("quantity", gorm.Expr("quantity - ?", claim.Taken)).
+			         Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gives the copies taken from the claims in affected to the same
+// decks' claims on collectionEntry, which has to have been saved
+func moveClaims(tx *gorm.DB, affected []AffectedAllocation, collectionEntry *models.CollectionEntry) error {
+	for _, claim := range affected {
+		allocation := models.DeckAllocation{
+			UserID: collectionEntry.UserID,
+			DeckID: claim.DeckID,
+			CollectionEntryID: collectionEntry.ID,
+			Quantity: claim.Taken,
+		}
+		err := tx.Omit(clause.Associations).
+		          Clauses(clause.OnConflict{
+		            Columns: []clause.Column{{Name: "deck_id"}, {Name: "collection_entry_id"}},
+		            DoUpdates: clause.Assignments(map[string]interface{}{
+		              "quantity": gorm.Expr("deck_allocations.quantity + excluded.quantity"),
+		              "updated_at": gorm.Expr("excluded.updated_at")})}).
+		          Create(&allocation).
+		          Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A user's collection entries with how many copies are allocated,
+// narrowed down by a HAVING condition on the allocated sum
+func entryAllocations(userID uint, having string) ([]EntryAllocation, error) {
+	entries := []EntryAllocation{}
+	err := db.Model(&models.CollectionEntry{}).
+	          Select("collection_entries.*, COALESCE(SUM(deck_allocations.quantity), 0) AS allocated").
+	          Joins("LEFT JOIN deck_allocations ON deck_allocations.collection_entry_id = collection_entries.id").
+	          Where("collection_entries.user_id = ?", userID).
+	          Group("collection_entries.id").
+	          Having(having).
+	          Order("collection_entries.id").
+	          Scan(&entries).
+	          Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		entries[i].Free = entries[i].Quantity - entries[i].Allocated
+	}
+	return entries, nil
+}
+
+// The allocations a deck has, along with the entries they're from
+func deckAllocations(deckID uint) ([]models.DeckAllocation, error) {
+	allocations := []models.DeckAllocation{}
+	err := db.Where("deck_id = ?", deckID).
+	          Preload("CollectionEntry").
+	          Order("id").
+	          Find(&allocations).
+	          Error
+	return allocations, err
+}
+
+func deckAllocationsEndpoint(c *gin.Context) {
+	id, ok := deckID(c)
+	if !ok {
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	deck, err := findDeck(user.ID, id)
+	if err != nil {
+		writeDeckError(c, err)
+		return
+	}
+
+	allocations, err := deckAllocations(deck.ID)
+	if err != nil {
+		log.Printf("Got unexpected error finding deck allocations: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, allocations)
+}
+
+// Claims copies in the collection for a deck. They have to be copies
+// of cards in the deck, though the maybeboard counts.
+func allocateToDeckEndpoint(c *gin.Context) {
+	id, ok := deckID(c)
+	if !ok {
+		return
+	}
+
+	var request AllocationRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+	if len(request.Entries) > maxDeckCards {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrTooManyUpdates.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	deck, err := findDeck(user.ID, id)
+	if err != nil {
+		writeDeckError(c, err)
+		return
+	}
+	inDeck := make(map[uuid.UUID]bool)
+	for _, card := range deck.Cards {
+		inDeck[card.OracleID] = true
+	}
+
+	result := AllocationResult{Errors: []BatchError{}}
+	var allocations []models.DeckAllocation
+	for i, entryRequest := range request.Entries {
+		err = entryRequest.validate()
+		if err == nil && entryRequest.Quantity < 0 {
+			err = ErrNegativeQuantity
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, BatchError{Index: i, Message: err.Error()})
+			continue
+		}
+
+		collectionEntry := entryRequest.entry(user.ID)
+		var found []struct {
+			ID uint
+			OracleID uuid.UUID
+		}
+		err = db.Model(&models.CollectionEntry{}).
+		         Select("collection_entries.id, cards.oracle_id").
+		         Joins("JOIN cards ON cards.id = collection_entries.card_id").
+		         Scopes(sameEntry(&collectionEntry)).
+		         Limit(1).
+		         Scan(&found).
+		         Error
+		if err != nil {
+			log.Printf("Got unexpected error finding collection entry: \"%s\"\n", err.Error())
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+			return
+		}
+		if len(found) == 0 {
+			result.Errors = append(result.Errors, BatchError{Index: i, Message: ErrEntryNotFound.Error()})
+			continue
+		}
+		if !inDeck[found[0].OracleID] {
+			result.Errors = append(result.Errors, BatchError{Index: i, Message: ErrCardNotInDeck.Error()})
+			continue
+		}
+
+		allocations = append(allocations, models.DeckAllocation{
+			UserID: user.ID,
+			DeckID: deck.ID,
+			CollectionEntryID: found[0].ID,
+			Quantity: entryRequest.Quantity,
+		})
+	}
+	if len(result.Errors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, allocation := range allocations {
+			var err error
+			if allocation.Quantity == 0 {
+				err = tx.Unscoped().
+				         Where("deck_id = ?", allocation.DeckID).
+				         Where("collection_entry_id = ?", allocation.CollectionEntryID).
+				         Delete(&models.DeckAllocation{}).
+				         Error
+			} else {
+				err = tx.Omit(clause.Associations).
+				         Clauses(clause.OnConflict{
+				           Columns: []clause.Column{{Name: "deck_id"}, {Name: "collection_entry_id"}},
+				           DoUpdates: clause.AssignmentColumns([]string{"quantity", "updated_at"})}).
+				         Create(&allocation).
+				         Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		result.Allocations, err = deckAllocations(deck.ID)
+	}
+	if err != nil {
+		log.Printf("Got unexpected error allocating to deck: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// The copies in a user's collection no deck has claimed
+func collectionFreeEndpoint(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	entries, err := entryAllocations(user.ID, "collection_entries.quantity > COALESCE(SUM(deck_allocations.quantity), 0)")
+	if err != nil {
+		log.Printf("Got unexpected error finding free collection entries: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// Reports the copies decks have claimed more of than there are,
+// and the cards decks need more of between them than the user owns,
+// whether or not they've been allocated
+func allocationReportEndpoint(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	report := AllocationReport{Short: []Shortage{}}
+	report.OverAllocated, err = entryAllocations(user.ID, "collection_entries.quantity < COALESCE(SUM(deck_allocations.quantity), 0)")
+	if err != nil {
+		log.Printf("Got unexpected error finding over-allocated entries: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	if len(report.OverAllocated) > 0 {
+		var entryIDs []uint
+		index := make(map[uint]int)
+		for i, entry := range report.OverAllocated {
+			entryIDs = append(entryIDs, entry.ID)
+			index[entry.ID] = i
+		}
+
+		var claims []struct {
+			CollectionEntryID uint
+			DeckClaim
+		}
+		err = db.Model(&models.DeckAllocation{}).
+		         Select("deck_allocations.collection_entry_id, decks.id AS deck_id, decks.name AS deck, deck_allocations.quantity").
+		         Joins("JOIN decks ON decks.id = deck_allocations.deck_id").
+		         Where("deck_allocations.collection_entry_id IN ?", entryIDs).
+		         Order("decks.name").
+		         Scan(&claims).
+		         Error
+		if err != nil {
+			log.Printf("Got unexpected error finding allocations: \"%s\"\n", err.Error())
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+			return
+		}
+		for _, claim := range claims {
+			entry := &report.OverAllocated[index[claim.CollectionEntryID]]
+			entry.Decks = append(entry.Decks, claim.DeckClaim)
+		}
+	}
+
+	// What every deck needs of each card, the maybeboard isn't needed
+	var needs []struct {
+		OracleID uuid.UUID
+		Name string
+		DeckClaim
+	}
+	err = db.Model(&models.DeckCard{}).
+	         Select("deck_cards.oracle_id, oracle_cards.name, decks.id AS deck_id, decks.name AS deck, SUM(deck_cards.quantity) AS quantity").
+	         Joins("JOIN decks ON decks.id = deck_cards.deck_id").
+	         Joins("LEFT JOIN oracle_cards ON oracle_cards.id = deck_cards.oracle_id").
+	         Where("decks.user_id = ?", user.ID).
+	         Where("deck_cards.zone <> ?", models.ZoneMaybe).
+	         Group("deck_cards.oracle_id, oracle_cards.name, decks.id, decks.name").
+	         Order("oracle_cards.name").
+	         Order("decks.name").
+	         Scan(&needs).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding deck needs: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	var shortages []Shortage
+	index := make(map[uuid.UUID]int)
+	var oracleIDs []uuid.UUID
+	for _, need := range needs {
+		if _, ok := index[need.OracleID]; !ok {
+			index[need.OracleID] = len(shortages)
+			shortages = append(shortages, Shortage{OracleID: need.OracleID, Name: need.Name})
+			oracleIDs = append(oracleIDs, need.OracleID)
+		}
+		shortage := &shortages[index[need.OracleID]]
+		shortage.Needed += need.Quantity
+		shortage.Decks = append(shortage.Decks, need.DeckClaim)
+	}
+
+	if len(oracleIDs) > 0 {
+		var owned []struct {
+			OracleID uuid.UUID
+			Quantity int
+		}
+		err = db.Scopes(userCollection(user.ID)).
+		         Select("cards.oracle_id, SUM(collection_entries.quantity) AS quantity").
+		         Where("cards.oracle_id IN ?", oracleIDs).
+		         Group("cards.oracle_id").
+		         Scan(&owned).
+		         Error
+		if err != nil {
+			log.Printf("Got unexpected error finding owned deck cards: \"%s\"\n", err.Error())
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+			return
+		}
+		for _, row := range owned {
+			shortages[index[row.OracleID]].Owned = row.Quantity
+		}
+	}
+
+	for _, shortage := range shortages {
+		if shortage.Needed > shortage.Owned {
+			report.Short = append(report.Short, shortage)
+		}
+	}
+
+	c.JSON(http.StatusOK, report)
+}
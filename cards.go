@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/cardname"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"github.com/toxicglados/umori-go/pkg/resolver"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+)
+
+type AutocompleteResult struct {
+	Names []string `json:"results"`
+}
+
+type CardResult struct {
+	Card models.Card `json:"card"`
+	Printings []models.Card `json:"printings"`
+}
+
+func fullCard(db *gorm.DB) *gorm.DB {
+	return db.Model(&models.Card{}).
+	          Preload("Set").
+	          Preload("Finishes").
+	          Preload("Faces").
+	          Preload("Legalities")
+}
+
+// Finds the other printings of card, one per printing
+// rather than one per language
+func otherPrintings(card models.Card) ([]models.Card, error) {
+	var printings []models.Card
+	err := db.Model(&models.Card{}).
+	          Preload("Set").
+	          Preload("Finishes").
+	          Where("oracle_id = ?", card.OracleID).
+	          Where("id <> ?", card.ID).
+	          Where("default_lang = true").
+	          Order("release_date desc").
+	          Order(collectorNumberOrder).
+	          Find(&printings).
+	          Error
+
+	return printings, err
+}
+
+func writeCardResult(c *gin.Context, card models.Card) {
+	printings, err := otherPrintings(card)
+	if err != nil {
+		log.Printf("Got unexpected error finding printings: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.JSON(http.StatusOK, CardResult{
+		Card: card,
+		Printings: printings,
+	})
+}
+
+func cardEndpoint(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidUUID.Error()})
+		return
+	}
+
+	var card models.Card
+	err = db.Scopes(fullCard).
+	         Where("id = ?", id).
+	         First(&card).
+	         Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrCardNotFound.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error finding card: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	writeCardResult(c, card)
+}
+
+// The set code comes from the "id" param because gin requires
+// every route to use the same name for a wildcard in the same position
+func cardBySetNumberEndpoint(c *gin.Context) {
+	setCode := strings.ToLower(c.Param("id"))
+	collectorNumber := c.Param("number")
+	language := strings.ToLower(c.Param("lang"))
+
+	result := db.Scopes(fullCard).
+	             Joins("JOIN sets ON sets.id = cards.set_id").
+	             Where("sets.code = ?", setCode).
+	             Where("cards.collector_number = ?", collectorNumber)
+
+	if language != "" {
+		result = result.Where("cards.language = ?", language)
+	} else {
+		// Without a language we want whatever printing
+		// scryfall considers the default
+		result = result.Order("cards.default_lang desc").
+		                Order(`
+		                CASE
+		                  WHEN cards.language = 'en' THEN 0
+		                  ELSE 1
+		                END`)
+	}
+
+	var card models.Card
+	err := result.First(&card).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrCardNotFound.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error finding card: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	writeCardResult(c, card)
+}
+
+func autocompleteEndpoint(c *gin.Context) {
+	query := cardname.Normalize(c.Query("q"))
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = autocompleteSize
+	} else if limit > maxAutocompleteSize {
+		limit = maxAutocompleteSize
+	}
+
+	names := []string{}
+	if query == "" {
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.JSON(http.StatusOK, AutocompleteResult{Names: names})
+		return
+	}
+
+	prefix := likeEscaper.Replace(query) + "%"
+
+	// <% is pg_trgm's word similarity operator, it matches when query
+	// is similar to some part of search_name which is what you want
+	// when someone has only typed part of a name. Both it and the LIKE
+	// can use the trigram index on search_name.
+	// Names that start with what was typed come first, then
+	// the rest are ranked by how similar they are.
+	err = db.Model(&models.Card{}).
+	         Select("name").
+	         Where("? <% search_name OR search_name LIKE ?", query, prefix).
+	         Group("name").
+	         Clauses(clause.OrderBy{Expression: clause.Expr{
+	             SQL: "MIN(CASE WHEN search_name LIKE ? THEN 0 ELSE 1 END), MAX(word_similarity(?, search_name)) DESC, name",
+	             Vars: []interface{}{prefix, query},
+	             WithoutParentheses: true,
+	         }}).
+	         Limit(limit).
+	         Pluck("name", &names).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error during autocomplete: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.JSON(http.StatusOK, AutocompleteResult{Names: names})
+}
+
+// Resolves a name the way someone might type or paste it,
+// "Mulldrifer" or "Jace, the Mind Sculptor (WWK)" for example.
+// The set, number and lang params override anything parsed out of name.
+func namedEndpoint(c *gin.Context) {
+	query := resolver.ParseQuery(c.Query("name"))
+	if query.Name == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrMissingName.Error()})
+		return
+	}
+	if set := c.Query("set"); set != "" {
+		query.SetCode = set
+	}
+	if number := c.Query("number"); number != "" {
+		query.CollectorNumber = number
+	}
+	query.Language = c.Query("lang")
+
+	switch match := resolver.MatchType(c.DefaultQuery("match", string(resolver.MatchFuzzy))); match {
+	case resolver.MatchExact, resolver.MatchInsensitive, resolver.MatchFuzzy:
+		query.Loosest = match
+	default:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrUnknownMatchType.Error()})
+		return
+	}
+
+	result, err := resolver.New(db).Resolve(query)
+	if err != nil {
+		log.Printf("Got unexpected error resolving name: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.JSON(http.StatusOK, result)
+}
+
+type PriceHistory struct {
+	CardID uuid.UUID `json:"card_id"`
+	Snapshots []models.PriceSnapshot `json:"snapshots"`
+}
+
+// A card's price snapshots from the last few days, oldest first
+func cardPricesEndpoint(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidUUID.Error()})
+		return
+	}
+
+	days, err := strconv.Atoi(c.Query("days"))
+	if err != nil || days <= 0 {
+		days = priceHistoryDays
+	}
+
+	history := PriceHistory{
+		CardID: id,
+		Snapshots: []models.PriceSnapshot{},
+	}
+	err = db.Model(&models.PriceSnapshot{}).
+	         Where("card_id = ?", id).
+	         Where("date >= ?", time.Now().AddDate(0, 0, -days)).
+	         Order("date").
+	         Find(&history.Snapshots).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding price history: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.JSON(http.StatusOK, history)
+}
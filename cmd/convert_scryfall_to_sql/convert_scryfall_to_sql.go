@@ -2,12 +2,12 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
+	"github.com/toxicglados/umori-go/pkg/alerts"
 	"github.com/toxicglados/umori-go/pkg/models"
 
 	"github.com/google/uuid"
@@ -16,27 +16,6 @@ import (
 	"gorm.io/gorm/clause"
 )
 
-func splitManaCost(manaCost string) ([]string, error){
-	var manaSymbols []string
-	var symbolAccumulator string = ""
-
-	for _, c := range manaCost {
-		char := string(c)
-		symbolAccumulator = symbolAccumulator + char
-		if char == "}" {
-			manaSymbols = append(manaSymbols, string(symbolAccumulator))
-			symbolAccumulator = ""
-		}
-	}
-
-	// TODO: Consider validating the mana symbol against a list of known ones
-	if symbolAccumulator != "" {
-		return nil, errors.New("Error parsing mana cost, unmatched {")
-	}
-
-	return manaSymbols, nil
-}
-
 type DefaultCard struct {	
 	ID uuid.UUID `json:"id"`
 }
@@ -82,9 +61,31 @@ func main() {
 	elapsed = end.Sub(start)
 	fmt.Printf("Unmarshal all: %s\n", elapsed)
 
+	// Every card carries its own copy of its set, so we
+	// collect them here and keep the one from the earliest
+	// card since that's the closest thing we have to a set
+	// release date
+	sets := make(map[uuid.UUID]models.Set)
+	// Printings don't carry their oracle card at all,
+	// so we make one from the first printing we see
+	oracleCards := make(map[uuid.UUID]models.OracleCard)
+
 	for i := range cards {
 		_, isDefault := defaultSet[cards[i].ID.String()]
 		cards[i].DefaultLang = isDefault
+
+		set, exists := sets[cards[i].Set.ID]
+		if !exists || cards[i].Set.ReleaseDate.Before(set.ReleaseDate.Time) {
+			sets[cards[i].Set.ID] = cards[i].Set
+		}
+
+		if _, exists := oracleCards[cards[i].OracleID]; !exists {
+			oracleCards[cards[i].OracleID] = models.OracleCard{
+				ID: cards[i].OracleID,
+				Name: cards[i].Name,
+				Layout: cards[i].Layout,
+			}
+		}
 	}
 
 	var dsn = "host=localhost user=postgres password=password dbname=postgres port=55432 TimeZone=America/Chicago"
@@ -93,7 +94,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	db.AutoMigrate(&models.Card{}, &models.Set{}, &models.Face{}, &models.Finish{})
+	db.AutoMigrate(&models.Card{}, &models.OracleCard{}, &models.Set{}, &models.Face{}, &models.Finish{}, &models.Legality{}, &models.PriceSnapshot{}, &models.AlertRule{}, &models.Notification{})
 
 	start = time.Now()
 
@@ -102,9 +103,38 @@ func main() {
 	// off of to make upsert work
 	db.Unscoped().Where("1 = 1").Delete(&models.Finish{})
 	db.Unscoped().Where("1 = 1").Delete(&models.Face{})
+	db.Unscoped().Where("1 = 1").Delete(&models.Legality{})
+
+	// Sets are saved before the cards because saving them
+	// as an association of the cards never updates existing rows
+	var setList []models.Set
+	for _, set := range sets {
+		setList = append(setList, set)
+	}
 
 	result := db.Clauses(clause.OnConflict{
 		UpdateAll: true,
+	}).CreateInBatches(setList, 1000)
+
+	if result.Error != nil {
+		log.Fatal(result.Error)
+	}
+
+	var oracleCardList []models.OracleCard
+	for _, oracleCard := range oracleCards {
+		oracleCardList = append(oracleCardList, oracleCard)
+	}
+
+	result = db.Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).CreateInBatches(oracleCardList, 1000)
+
+	if result.Error != nil {
+		log.Fatal(result.Error)
+	}
+
+	result = db.Clauses(clause.OnConflict{
+		UpdateAll: true,
 	}).CreateInBatches(cards, 1000)
 
 	if result.Error != nil {
@@ -113,4 +143,43 @@ func main() {
 	end = time.Now()
 	elapsed = end.Sub(start)
 	fmt.Printf("Save all: %s\n", elapsed)
+
+	// Card prices are overwritten every import so we keep a dated copy
+	// of them. Importing more than once in a day updates that day's copy.
+	start = time.Now()
+	year, month, day := start.Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+
+	var snapshots []models.PriceSnapshot
+	for _, card := range cards {
+		if !card.Prices.IsEmpty() {
+			snapshots = append(snapshots, models.PriceSnapshot{
+				CardID: card.ID,
+				Date: today,
+				Prices: card.Prices,
+			})
+		}
+	}
+
+	result = db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "card_id"}, {Name: "date"}},
+		UpdateAll: true,
+	}).CreateInBatches(snapshots, 1000)
+
+	if result.Error != nil {
+		log.Fatal(result.Error)
+	}
+	end = time.Now()
+	elapsed = end.Sub(start)
+	fmt.Printf("Save price snapshots: %s\n", elapsed)
+
+	// Now that today's prices are in we can see whose alerts they set off
+	start = time.Now()
+	notified, err := alerts.Evaluate(db, today)
+	if err != nil {
+		log.Fatal(err)
+	}
+	end = time.Now()
+	elapsed = end.Sub(start)
+	fmt.Printf("Evaluate alerts: %s, %d notifications\n", elapsed, notified)
 }
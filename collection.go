@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/collectioncsv"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+)
+
+// How much of an oracle card a user owns, across all its printings
+type OracleSummary struct {
+	OracleID uuid.UUID `json:"oracle_id"`
+	Name string `json:"name"`
+	Quantity int `json:"quantity"`
+}
+
+type OracleSummaryResult struct {
+	PagedResult
+	Cards []OracleSummary `json:"results"`
+}
+
+type OracleCollectionResult struct {
+	OracleSummary
+	Entries []models.CollectionEntry `json:"entries"`
+}
+
+func findUser(username string) (models.User, error) {
+	var user models.User
+	err := db.Model(&models.User{}).
+	          Select("id").
+	          Where("username = ?", username).
+	          First(&user).
+	          Error
+
+	return user, err
+}
+
+// Writes the error response for a failed findUser
+func writeFindUserError(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrUserNotFound.Error()})
+	} else {
+		log.Printf("Got unexpected error finding user: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+	}
+}
+
+// A user's collection entries joined with the cards they're for
+func userCollection(userID uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Model(&models.CollectionEntry{}).
+		          Joins("JOIN cards ON cards.id = collection_entries.card_id").
+		          Where("collection_entries.user_id = ?", userID)
+	}
+}
+
+// Joins the sets of the cards in userCollection. Scopes run after
+// everything else, so this has to be a scope too for the joins to
+// come out in the right order.
+func withSets(db *gorm.DB) *gorm.DB {
+	return db.Joins("JOIN sets ON sets.id = cards.set_id")
+}
+
+// Lists every oracle card in a user's collection along with how many
+// they own across all printings. Can be narrowed down with location_id and tag.
+func collectionSummaryEndpoint(c *gin.Context) {
+	filter, err := collectionFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	var count int64
+	err = db.Scopes(userCollection(user.ID), filter).
+	         Distinct("cards.oracle_id").
+	         Count(&count).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error counting collection: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	summaries := []OracleSummary{}
+	err = db.Scopes(userCollection(user.ID), filter).
+	         Select("cards.oracle_id, MIN(cards.name) AS name, SUM(collection_entries.quantity) AS quantity").
+	         Group("cards.oracle_id").
+	         Order("name").
+	         Scopes(Paginate(c)).
+	         Scan(&summaries).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error summarizing collection: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	offset, exists := c.Get("offset")
+	if !exists {
+		log.Fatal(errors.New("Couldn't find offset in context"))
+	}
+
+	c.JSON(http.StatusOK, OracleSummaryResult{
+		PagedResult: NewPagedResult(count, offset.(int64)),
+		Cards: summaries,
+	})
+}
+
+// How many of an oracle card a user owns, with the entries for each printing
+func collectionGetOracleCard(c *gin.Context) {
+	oracleID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidUUID.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	var oracleCard models.OracleCard
+	err = db.Model(&models.OracleCard{}).
+	         Where("id = ?", oracleID).
+	         First(&oracleCard).
+	         Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrCardNotFound.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error finding oracle card: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	entries := []models.CollectionEntry{}
+	err = db.Scopes(userCollection(user.ID)).
+	         Where("cards.oracle_id = ?", oracleID).
+	         Find(&entries).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding collection entries: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	result := OracleCollectionResult{
+		OracleSummary: OracleSummary{
+			OracleID: oracleCard.ID,
+			Name: oracleCard.Name,
+		},
+		Entries: entries,
+	}
+	for _, entry := range entries {
+		result.Quantity += entry.Quantity
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// Exports a user's collection as CSV that another tool can import,
+// narrowed down with location_id and tag. Rows are written as we
+// read them so large collections don't have to fit in memory.
+func collectionExportEndpoint(c *gin.Context) {
+	filter, err := collectionFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	name := c.DefaultQuery("format", collectioncsv.Moxfield.Name)
+	if name == textFormat {
+		exportCollectionDecklist(c, filter)
+		return
+	}
+
+	format, ok := collectioncsv.Lookup(name)
+	if !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrUnknownFormat.Error()})
+		return
+	}
+
+	username := c.Param("user")
+	user, err := findUser(username)
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	rows, err := db.Scopes(userCollection(user.ID), withSets, filter).
+	                Select("collection_entries.quantity, cards.name, sets.code AS set_code, sets.name AS set_name, " +
+	                       "cards.collector_number, collection_entries.finish, cards.language, " +
+	                       "collection_entries.condition, cards.id AS scryfall_id").
+	                Where("collection_entries.quantity > 0").
+	                Order("sets.code").
+	                Order(collectorNumberOrder).
+	                Order("cards.collector_number").
+	                Rows()
+	if err != nil {
+		log.Printf("Got unexpected error exporting collection: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.csv"`, username, format.Name))
+	c.Status(http.StatusOK)
+
+	// Once we've started writing there's no way to send
+	// an error response, the best we can do is log it
+	writer := collectioncsv.NewWriter(c.Writer, format)
+	for rows.Next() {
+		var row collectioncsv.Row
+		err = db.ScanRows(rows, &row)
+		if err == nil {
+			err = writer.Write(row)
+		}
+		if err != nil {
+			log.Printf("Got unexpected error writing collection export: \"%s\"\n", err.Error())
+			return
+		}
+	}
+	err = rows.Err()
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		log.Printf("Got unexpected error writing collection export: \"%s\"\n", err.Error())
+	}
+}
+
+type BatchUpdate struct {
+	UpdateRequest
+	// Sets the quantity outright instead of adding Quantity to it
+	Set *int `json:"set"`
+	// Like an If-Match header, but for just this entry
+	IfMatch string `json:"if_match"`
+}
+
+// Why one of the updates in a batch couldn't be applied,
+// Index is its position in the batch
+type BatchError struct {
+	Index int `json:"index"`
+	Message string `json:"message"`
+}
+
+type BatchResult struct {
+	// Identifies the batch's changes in the collection history
+	BatchID *uuid.UUID `json:"batch_id,omitempty"`
+	// The entries after each update, in the same order as the batch
+	Entries []models.CollectionEntry `json:"entries"`
+	Errors []BatchError `json:"errors"`
+}
+
+// Applies many updates at once. They're all applied in a single
+// transaction, so if any of them are invalid none of them are applied.
+// If any entry has changed since its if_match none are applied either.
+// Entries that reach zero are removed.
+func batchUpdateCollection(c *gin.Context) {
+	var updates []BatchUpdate
+	err := c.ShouldBindJSON(&updates)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+	if len(updates) > maxBatchSize {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrTooManyUpdates.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	var ids []uuid.UUID
+	var locationIDs []uint
+	for _, update := range updates {
+		ids = append(ids, update.CardID)
+		locationIDs = append(locationIDs, update.LocationID)
+	}
+	exists, err := existingCards(ids)
+	if err != nil {
+		log.Printf("Got unexpected error finding cards: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	locations, err := existingLocations(user.ID, locationIDs)
+	if err != nil {
+		log.Printf("Got unexpected error finding locations: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	result := BatchResult{
+		Entries: []models.CollectionEntry{},
+		Errors: []BatchError{},
+	}
+	for i := range updates {
+		err = updates[i].validate()
+		if err == nil && updates[i].Set != nil {
+			if updates[i].Quantity != 0 {
+				err = ErrQuantityAndSet
+			} else if *updates[i].Set < 0 {
+				err = ErrNegativeQuantity
+			}
+		}
+		if err == nil && !exists[updates[i].CardID] {
+			err = ErrCardNotFound
+		}
+		if err == nil && !locations[updates[i].LocationID] {
+			err = ErrLocationNotFound
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, BatchError{Index: i, Message: err.Error()})
+		}
+	}
+	if len(result.Errors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	// The batch's changes share an ID so they can be reverted together
+	batchID := uuid.New()
+	result.BatchID = &batchID
+	change := models.CollectionChange{ActorID: user.ID, Source: models.ChangeSourceManual, BatchID: &batchID}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Everything is checked before anything changes, otherwise
+		// an entry in the batch twice would fail its own check
+		for i, update := range updates {
+			entry := update.entry(user.ID)
+			err := checkETag(tx, &entry, update.IfMatch)
+			if errors.Is(err, ErrEntryChanged) {
+				result.Errors = append(result.Errors, BatchError{Index: i, Message: err.Error()})
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(result.Errors) > 0 {
+			return ErrEntryChanged
+		}
+
+		for _, update := range updates {
+			entry := update.entry(user.ID)
+			var err error
+			if update.Set != nil {
+				entry.Quantity = *update.Set
+				err = setInCollection(tx, &entry, change)
+			} else {
+				err = addToCollection(tx, &entry, change)
+			}
+			if err != nil {
+				return err
+			}
+			result.Entries = append(result.Entries, entry)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrEntryChanged) {
+		result.BatchID = nil
+		c.JSON(http.StatusPreconditionFailed, result)
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error applying batch update: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/toxicglados/umori-go/pkg/decklist"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"github.com/toxicglados/umori-go/pkg/resolver"
+	"gorm.io/gorm"
+)
+
+// The format name for plain text decklists like "4 Lightning Bolt (M10) 146"
+const textFormat = "text"
+
+// Imports a plain text decklist into a collection. Every
+// section counts, a sideboard is still cards they own.
+func importDecklist(c *gin.Context, result ImportResult) {
+	result.Format = textFormat
+
+	entries, lineErrors, err := decklist.Parse(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidDecklist.Error()})
+		return
+	}
+
+	for _, lineError := range lineErrors {
+		result.Problems = append(result.Problems, ImportProblem{
+			Line: lineError.Line,
+			Name: lineError.Text,
+			Message: lineError.Err.Error(),
+		})
+	}
+
+	var lines []importLine
+	for _, entry := range entries {
+		lines = append(lines, importLine{
+			Line: entry.Line,
+			Query: resolver.Query{
+				Name: entry.Name,
+				SetCode: entry.SetCode,
+				CollectorNumber: entry.CollectorNumber,
+			},
+			Finish: entry.Finish,
+			Condition: models.ConditionNearMint,
+			Quantity: entry.Quantity,
+		})
+	}
+
+	runImport(c, result, lines)
+}
+
+// Exports a collection as a plain text decklist. Decklists don't
+// have conditions or locations so those are added together.
+func exportCollectionDecklist(c *gin.Context, filter func(db *gorm.DB) *gorm.DB) {
+	username := c.Param("user")
+	user, err := findUser(username)
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	rows, err := db.Scopes(userCollection(user.ID), withSets, filter).
+	                Select("cards.name, sets.code AS set_code, cards.collector_number, collection_entries.finish, " +
+	                       "SUM(collection_entries.quantity) AS quantity").
+	                Where("collection_entries.quantity > 0").
+	                Group("cards.id, cards.name, sets.code, cards.collector_number, collection_entries.finish").
+	                Order("sets.code").
+	                Order(collectorNumberOrder).
+	                Order("cards.collector_number").
+	                Rows()
+	if err != nil {
+		log.Printf("Got unexpected error exporting collection: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.txt"`, username))
+	c.Status(http.StatusOK)
+
+	writer := decklist.NewWriter(c.Writer)
+	for rows.Next() {
+		var entry decklist.Entry
+		err = db.ScanRows(rows, &entry)
+		if err == nil {
+			err = writer.Write(entry)
+		}
+		if err != nil {
+			log.Printf("Got unexpected error writing collection export: \"%s\"\n", err.Error())
+			return
+		}
+	}
+	err = rows.Err()
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		log.Printf("Got unexpected error writing collection export: \"%s\"\n", err.Error())
+	}
+}
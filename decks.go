@@ -0,0 +1,534 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/decks"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxDeckCards = 250
+
+type DeckCardRequest struct {
+	// Either is fine, a printing is just used to find the oracle card
+	CardID *uuid.UUID `json:"card_id"`
+	OracleID *uuid.UUID `json:"oracle_id"`
+	// Defaults to main
+	Zone string `json:"zone"`
+	Quantity int `json:"quantity"`
+}
+
+type DeckRequest struct {
+	Name string `json:"name"`
+	// What legality checks use when they aren't given a format
+	Format string `json:"format"`
+	Cards []DeckCardRequest `json:"cards"`
+}
+
+// A deck without its cards, for listing
+type DeckSummary struct {
+	ID uint `json:"id"`
+	Name string `json:"name"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Every card outside the maybeboard
+	Cards int `json:"cards"`
+}
+
+// How much of a deck a collection covers
+type DeckOwnership struct {
+	DeckID uint `json:"deck_id"`
+	Name string `json:"name"`
+	Cards []decks.CardOwnership `json:"cards"`
+	Needed int `json:"needed"`
+	Missing int `json:"missing"`
+	// Whether they own enough to build the deck
+	Complete bool `json:"complete"`
+}
+
+// Checks the cards in a DeckRequest, finds the oracle card for any given
+// by printing and adds up copies of the same card in the same zone
+func (request DeckRequest) cards() ([]models.DeckCard, error) {
+	if len(request.Cards) > maxDeckCards {
+		return nil, ErrTooManyDeckCards
+	}
+
+	var cardIDs, oracleIDs []uuid.UUID
+	for i, cardRequest := range request.Cards {
+		if (cardRequest.CardID == nil) == (cardRequest.OracleID == nil) || cardRequest.Quantity <= 0 {
+			return nil, ErrInvalidDeckCard
+		}
+		if cardRequest.Zone == "" {
+			request.Cards[i].Zone = models.ZoneMain
+		} else if !models.IsZone(cardRequest.Zone) {
+			return nil, ErrUnknownZone
+		}
+
+		if cardRequest.CardID != nil {
+			cardIDs = append(cardIDs, *cardRequest.CardID)
+		} else {
+			oracleIDs = append(oracleIDs, *cardRequest.OracleID)
+		}
+	}
+
+	oracles := make(map[uuid.UUID]uuid.UUID)
+	if len(cardIDs) > 0 {
+		var printings []models.Card
+		err := db.Model(&models.Card{}).
+		          Select("id", "oracle_id").
+		          Where("id IN ?", cardIDs).
+		          Find(&printings).
+		          Error
+		if err != nil {
+			return nil, err
+		}
+		for _, printing := range printings {
+			oracles[printing.ID] = printing.OracleID
+		}
+	}
+	if len(oracleIDs) > 0 {
+		var found []uuid.UUID
+		err := db.Model(&models.OracleCard{}).
+		          Where("id IN ?", oracleIDs).
+		          Pluck("id", &found).
+		          Error
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range found {
+			oracles[id] = id
+		}
+	}
+
+	var cards []models.DeckCard
+	for _, cardRequest := range request.Cards {
+		id := cardRequest.OracleID
+		if id == nil {
+			id = cardRequest.CardID
+		}
+		oracleID, ok := oracles[*id]
+		if !ok {
+			return nil, ErrCardNotFound
+		}
+
+		found := false
+		for i := range cards {
+			if cards[i].OracleID == oracleID && cards[i].Zone == cardRequest.Zone {
+				cards[i].Quantity += cardRequest.Quantity
+				found = true
+				break
+			}
+		}
+		if !found {
+			cards = append(cards, models.DeckCard{OracleID: oracleID, Zone: cardRequest.Zone, Quantity: cardRequest.Quantity})
+		}
+	}
+	return cards, nil
+}
+
+// Reads and checks a DeckRequest, writing out the error if it's no good
+func readDeckRequest(c *gin.Context) (models.Deck, bool) {
+	var request DeckRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return models.Deck{}, false
+	}
+	deck := models.Deck{
+		Name: strings.TrimSpace(request.Name),
+		Format: strings.ToLower(request.Format),
+	}
+	if deck.Name == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrMissingName.Error()})
+		return deck, false
+	}
+	if deck.Format != "" && !decks.IsFormat(deck.Format) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrUnknownDeckFormat.Error()})
+		return deck, false
+	}
+
+	deck.Cards, err = request.cards()
+	if errors.Is(err, ErrCardNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrCardNotFound.Error()})
+		return deck, false
+	} else if errors.Is(err, ErrTooManyDeckCards) || errors.Is(err, ErrInvalidDeckCard) || errors.Is(err, ErrUnknownZone) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return deck, false
+	} else if err != nil {
+		log.Printf("Got unexpected error finding deck cards: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return deck, false
+	}
+	return deck, true
+}
+
+// Replaces the cards in a deck
+func saveDeckCards(tx *gorm.DB, deckID uint, cards []models.DeckCard) error {
+	err := tx.Unscoped().
+	          Where("deck_id = ?", deckID).
+	          Delete(&models.DeckCard{}).
+	          Error
+	if err != nil || len(cards) == 0 {
+		return err
+	}
+
+	for i := range cards {
+		cards[i].DeckID = deckID
+	}
+	return tx.Omit(clause.Associations).Create(&cards).Error
+}
+
+// Finds one of a user's decks along with its cards
+func findDeck(userID uint, id uint64) (models.Deck, error) {
+	var deck models.Deck
+	err := db.Where("id = ?", id).
+	          Where("user_id = ?", userID).
+	          First(&deck).
+	          Error
+	if err != nil {
+		return deck, err
+	}
+
+	deck.Cards = []models.DeckCard{}
+	err = db.Model(&models.DeckCard{}).
+	         Select("deck_cards.*, oracle_cards.name").
+	         Joins("LEFT JOIN oracle_cards ON oracle_cards.id = deck_cards.oracle_id").
+	         Where("deck_cards.deck_id = ?", deck.ID).
+	         Order("deck_cards.id").
+	         Find(&deck.Cards).
+	         Error
+	return deck, err
+}
+
+// Writes the error response for a deck that couldn't be found or saved
+func writeDeckError(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, ErrDeckNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrDeckNotFound.Error()})
+	} else if errors.Is(err, gorm.ErrDuplicatedKey) {
+		c.JSON(http.StatusConflict, ErrorResponse{Message: ErrDeckExists.Error()})
+	} else {
+		log.Printf("Got unexpected error with deck: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+	}
+}
+
+// Reads the deck id in the path, writing out a 404 if it isn't one
+func deckID(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrDeckNotFound.Error()})
+		return 0, false
+	}
+	return id, true
+}
+
+// Lists a user's decks and how many cards are in each
+func decksEndpoint(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	summaries := []DeckSummary{}
+	err = db.Model(&models.Deck{}).
+	         Select("decks.id, decks.name, decks.updated_at, COALESCE(SUM(deck_cards.quantity), 0) AS cards").
+	         Joins("LEFT JOIN deck_cards ON deck_cards.deck_id = decks.id AND deck_cards.zone <> ?", models.ZoneMaybe).
+	         Where("decks.user_id = ?", user.ID).
+	         Group("decks.id, decks.name, decks.updated_at").
+	         Order("decks.name").
+	         Scan(&summaries).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding decks: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, summaries)
+}
+
+func deckEndpoint(c *gin.Context) {
+	id, ok := deckID(c)
+	if !ok {
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	deck, err := findDeck(user.ID, id)
+	if err != nil {
+		writeDeckError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, deck)
+}
+
+func createDeckEndpoint(c *gin.Context) {
+	deck, ok := readDeckRequest(c)
+	if !ok {
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	deck.UserID = user.ID
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Omit(clause.Associations).Create(&deck).Error
+		if err != nil {
+			return err
+		}
+		return saveDeckCards(tx, deck.ID, deck.Cards)
+	})
+	if err == nil {
+		deck, err = findDeck(user.ID, uint64(deck.ID))
+	}
+	if err != nil {
+		writeDeckError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, deck)
+}
+
+// Replaces a deck's name, format and cards with the ones in the request
+func updateDeckEndpoint(c *gin.Context) {
+	id, ok := deckID(c)
+	if !ok {
+		return
+	}
+	request, ok := readDeckRequest(c)
+	if !ok {
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Deck{}).
+		             Where("id = ?", id).
+		             Where("user_id = ?", user.ID).
+		             Updates(map[string]interface{}{"name": request.Name, "format": request.Format})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrDeckNotFound
+		}
+		return saveDeckCards(tx, uint(id), request.Cards)
+	})
+	var deck models.Deck
+	if err == nil {
+		deck, err = findDeck(user.ID, id)
+	}
+	if err != nil {
+		writeDeckError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, deck)
+}
+
+func deleteDeckEndpoint(c *gin.Context) {
+	id, ok := deckID(c)
+	if !ok {
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	// Deleted for good so the name can be used again,
+	// its cards go with it
+	result := db.Unscoped().
+	             Where("id = ?", id).
+	             Where("user_id = ?", user.ID).
+	             Delete(&models.Deck{})
+	err = result.Error
+	if err == nil && result.RowsAffected == 0 {
+		err = ErrDeckNotFound
+	}
+	if err != nil {
+		writeDeckError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// How many of each card in a deck the user owns, in any printing,
+// and how many more they'd need to build it
+func deckOwnershipEndpoint(c *gin.Context) {
+	id, ok := deckID(c)
+	if !ok {
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	deck, err := findDeck(user.ID, id)
+	if err != nil {
+		writeDeckError(c, err)
+		return
+	}
+
+	var oracleIDs []uuid.UUID
+	for _, card := range deck.Cards {
+		oracleIDs = append(oracleIDs, card.OracleID)
+	}
+
+	var rows []struct {
+		OracleID uuid.UUID
+		Quantity int
+	}
+	if len(oracleIDs) > 0 {
+		err = db.Scopes(userCollection(user.ID)).
+		         Select("cards.oracle_id, SUM(collection_entries.quantity) AS quantity").
+		         Where("cards.oracle_id IN ?", oracleIDs).
+		         Group("cards.oracle_id").
+		         Scan(&rows).
+		         Error
+	}
+	if err != nil {
+		log.Printf("Got unexpected error finding owned deck cards: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	owned := make(map[uuid.UUID]int)
+	for _, row := range rows {
+		owned[row.OracleID] = row.Quantity
+	}
+
+	result := DeckOwnership{DeckID: deck.ID, Name: deck.Name, Cards: []decks.CardOwnership{}}
+	cards, missing := decks.Ownership(deck.Cards, owned)
+	if cards != nil {
+		result.Cards = cards
+	}
+	for _, card := range result.Cards {
+		result.Needed += card.Needed
+	}
+	result.Missing = missing
+	result.Complete = missing == 0
+
+	c.JSON(http.StatusOK, result)
+}
+
+// What the format rules need to know about each oracle card in ids,
+// taken from their most recent English printing
+func deckCardInfo(ids []uuid.UUID, format string) (map[uuid.UUID]decks.CardInfo, error) {
+	info := make(map[uuid.UUID]decks.CardInfo)
+	if len(ids) == 0 {
+		return info, nil
+	}
+
+	var printings []models.Card
+	err := db.Model(&models.Card{}).
+	          Select("DISTINCT ON (oracle_id) cards.*").
+	          Preload("Faces").
+	          Preload("Legalities", "format = ?", format).
+	          Where("oracle_id IN ?", ids).
+	          Order("oracle_id").
+	          Scopes(printingOrder).
+	          Find(&printings).
+	          Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, printing := range printings {
+		typeLines := []string{printing.TypeLine}
+		oracleTexts := []string{printing.OracleText}
+		for _, face := range printing.Faces {
+			typeLines = append(typeLines, face.TypeLine)
+			oracleTexts = append(oracleTexts, face.OracleText)
+		}
+
+		cardInfo := decks.CardInfo{
+			Name: printing.Name,
+			TypeLine: strings.Join(typeLines, "\n"),
+			OracleText: strings.Join(oracleTexts, "\n"),
+			ColorIdentity: printing.ColorIdentity,
+		}
+		if len(printing.Legalities) > 0 {
+			cardInfo.Status = printing.Legalities[0].Status
+		}
+		info[printing.OracleID] = cardInfo
+	}
+	return info, nil
+}
+
+// Checks a deck against the rules of the format given by "format",
+// or the deck's own format if there isn't one
+func deckLegalityEndpoint(c *gin.Context) {
+	id, ok := deckID(c)
+	if !ok {
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	deck, err := findDeck(user.ID, id)
+	if err != nil {
+		writeDeckError(c, err)
+		return
+	}
+
+	name := strings.ToLower(c.DefaultQuery("format", deck.Format))
+	if name == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrMissingDeckFormat.Error()})
+		return
+	}
+	format, ok := decks.Formats[name]
+	if !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrUnknownDeckFormat.Error()})
+		return
+	}
+
+	var oracleIDs []uuid.UUID
+	for _, card := range deck.Cards {
+		if card.Zone != models.ZoneMaybe {
+			oracleIDs = append(oracleIDs, card.OracleID)
+		}
+	}
+	info, err := deckCardInfo(oracleIDs, format.Name)
+	if err != nil {
+		log.Printf("Got unexpected error finding deck card rules: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, decks.Validate(format, deck.Cards, info))
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/golang-jwt/jwt"
 	"github.com/toxicglados/umori-go/pkg/crypto"
 	"github.com/toxicglados/umori-go/pkg/models"
+	"github.com/toxicglados/umori-go/pkg/trades"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -222,8 +223,11 @@ func TestCollectionUpdate(t *testing.T) {
 	quantity := 5
 
 	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(mulldrifter_id))
 	mock.ExpectBegin()
-	mock.ExpectQuery("^INSERT INTO \"collection_entries\" (.+) ON CONFLICT (.+)$").WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, quantity, quantity).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "quantity"}).AddRow(1, mulldrifter_id, quantity))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}))
+	mock.ExpectQuery("^INSERT INTO \"collection_entries\" (.+) ON CONFLICT (.+)$").WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "nonfoil", "near_mint", 0, quantity, 1, quantity).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "quantity"}).AddRow(1, mulldrifter_id, "nonfoil", "near_mint", quantity))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 	mock.ExpectCommit()
 
 	body := fmt.Sprintf(`{"card_id": "%s", "quantity": %d}`, mulldrifter_id, quantity)
@@ -400,6 +404,1561 @@ func TestCollectionGetByIDNoneInCollection(t *testing.T) {
 	}
 }
 
+func TestSets(t *testing.T) {
+	set_id := "a4a0db50-8826-4e73-833c-3fd934375f96"
+	mock.ExpectQuery(`^SELECT count\(\*\) FROM "sets" WHERE type = \$1 (.+)$`).WithArgs("core").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT \* FROM "sets" WHERE type = \$1 (.+) ORDER BY release_date desc,name LIMIT 30$`).WithArgs("core").WillReturnRows(sqlmock.NewRows([]string{"id", "name", "type", "code"}).AddRow(set_id, "Magic 2010", "core", "m10"))
+
+	w := callEndpoint("", "GET", "/api/sets?type=core")
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response SetsResult
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Total != 1 || len(response.Sets) != 1 {
+		t.Fatalf("Expected 1 set, got %d", len(response.Sets))
+	} else if response.Sets[0].Code != "m10" {
+		t.Fatalf("Expected set code \"m10\", got \"%s\"", response.Sets[0].Code)
+	}
+}
+
+func TestSetNotFound(t *testing.T) {
+	mock.ExpectQuery(`^SELECT \* FROM "sets" WHERE code = \$1 (.+)$`).WithArgs("xyz").WillReturnRows(sqlmock.NewRows([]string{"id", "code"}))
+
+	w := callEndpoint("", "GET", "/api/sets/XYZ")
+
+	errorResponse := ErrorResponse{Message: ErrSetNotFound.Error()}
+	err := validateErrorResponse(w, 404, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCardInvalidID(t *testing.T) {
+	w := callEndpoint("", "GET", "/api/cards/not_a_uuid")
+
+	errorResponse := ErrorResponse{Message: ErrInvalidUUID.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCardBySetNumberNotFound(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "cards"."(.+) FROM "cards" JOIN sets ON sets.id = cards.set_id WHERE sets.code = \$1 AND cards.collector_number = \$2 AND cards.language = \$3 (.+)$`).WithArgs("m10", "146", "ja").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	w := callEndpoint("", "GET", "/api/cards/M10/146/ja")
+
+	errorResponse := ErrorResponse{Message: ErrCardNotFound.Error()}
+	err := validateErrorResponse(w, 404, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAutocomplete(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "name" FROM "cards" WHERE \(\$1 <% search_name OR search_name LIKE \$2\) (.+) GROUP BY "name" ORDER BY (.+) LIMIT 5$`).WithArgs("lim-dul", "lim-dul%", "lim-dul%", "lim-dul").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Lim-Dûl's Vault").AddRow("Lim-Dûl the Necromancer"))
+
+	w := callEndpoint("", "GET", "/api/cards/autocomplete?q=Lim-D%C3%BBl&limit=5")
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response AutocompleteResult
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Names) != 2 || response.Names[0] != "Lim-Dûl's Vault" {
+		t.Fatalf("Unexpected autocomplete results %v", response.Names)
+	}
+}
+
+func TestNamedAmbiguous(t *testing.T) {
+	mock.ExpectQuery(`^SELECT DISTINCT "name" FROM "cards" WHERE name = \$1 (.+)$`).WithArgs("Bolt").WillReturnRows(sqlmock.NewRows([]string{"name"}))
+	mock.ExpectQuery(`^SELECT DISTINCT "name" FROM "cards" WHERE name LIKE \$1 (.+)$`).WithArgs("Bolt // %").WillReturnRows(sqlmock.NewRows([]string{"name"}))
+	mock.ExpectQuery(`^SELECT DISTINCT "name" FROM "cards" WHERE \(search_name = \$1 OR search_name LIKE \$2\) (.+)$`).WithArgs("bolt", "bolt // %").WillReturnRows(sqlmock.NewRows([]string{"name"}))
+	mock.ExpectQuery(`^SELECT "name" FROM "cards" WHERE search_name % \$1 (.+) GROUP BY "name" ORDER BY (.+) LIMIT 5$`).WithArgs("bolt", "bolt").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Bola").AddRow("Boot"))
+
+	w := callEndpoint("", "GET", "/api/cards/named?name=Bolt")
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Status string
+		Candidates []string
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Status != "ambiguous" || len(response.Candidates) != 2 {
+		t.Fatalf("Expected ambiguous result with 2 candidates, got %+v", response)
+	}
+}
+
+func TestNamedWrongCollectorNumber(t *testing.T) {
+	set_id := "485d2468-18b9-4cc2-a6d4-0e3c1e9a9b80"
+	mock.ExpectQuery(`^SELECT "cards"."(.+) FROM "cards" JOIN sets ON sets.id = cards.set_id WHERE sets.code = \$1 AND cards.collector_number = \$2 (.+)$`).WithArgs("m11", "150").WillReturnRows(sqlmock.NewRows([]string{"id", "name", "set_id"}).AddRow(mulldrifter_id, "Lava Axe", set_id))
+	mock.ExpectQuery(`^SELECT \* FROM "faces" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "finishes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "legalities" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "sets" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id", "code"}).AddRow(set_id, "m11"))
+	mock.ExpectQuery(`^SELECT DISTINCT "name" FROM "cards" WHERE name = \$1 (.+)$`).WithArgs("Lightning Bolt").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Lightning Bolt"))
+
+	w := callEndpoint("", "GET", "/api/cards/named?name=Lightning%20Bolt%20(M11)%20150")
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Status string
+		Candidates []string
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Status != "ambiguous" || len(response.Candidates) != 2 || response.Candidates[0] != "Lightning Bolt" || response.Candidates[1] != "Lava Axe" {
+		t.Fatalf("Expected the named card and the numbered one as candidates, got %+v", response)
+	}
+}
+
+func TestNamedUnknownMatchType(t *testing.T) {
+	w := callEndpoint("", "GET", "/api/cards/named?name=Bolt&match=psychic")
+
+	errorResponse := ErrorResponse{Message: ErrUnknownMatchType.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchLegalIn(t *testing.T) {
+	mock.ExpectQuery(`^SELECT count\(\*\) FROM "cards" WHERE (.+) AND \(EXISTS \(SELECT 1 FROM legalities WHERE (.+) legalities.format = \$2 AND legalities.status IN \('legal', 'restricted'\)\)\) (.+)$`).WithArgs("%%", "commander").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(`^SELECT \* FROM "cards" WHERE (.+) AND \(EXISTS \(SELECT 1 FROM legalities (.+)$`).WithArgs("%%", "commander").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	w := callEndpoint("", "GET", "/api/cards/search?legal=Commander")
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchInvalidColor(t *testing.T) {
+	w := callEndpoint("", "GET", "/api/cards/search?colors=WX")
+
+	errorResponse := ErrorResponse{Message: "Invalid color: X"}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchCollapsePrintings(t *testing.T) {
+	mock.ExpectQuery(`^SELECT COUNT\(DISTINCT\("oracle_id"\)\) FROM "cards" (.+)$`).WithArgs("%bolt%").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT \* FROM \(SELECT DISTINCT ON \(oracle_id\) \* FROM "cards" WHERE (.+) ORDER BY oracle_id,(.+)\) AS cards WHERE "cards"."deleted_at" IS NULL ORDER BY name,(.+) LIMIT 30$`).WithArgs("%bolt%").WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(mulldrifter_id, "Lightning Bolt"))
+	mock.ExpectQuery(`^SELECT \* FROM "faces" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "finishes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "legalities" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id", "format", "status"}).AddRow(mulldrifter_id, "modern", "legal"))
+
+	w := callEndpoint("", "GET", "/api/cards/search?nameContains=bolt&collapsePrintings=true")
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Results []struct {
+			Legalities map[string]string
+		}
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Results[0].Legalities["modern"] != "legal" {
+		t.Fatalf("Expected card to be legal in modern, got %v", response.Results[0].Legalities)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionSummary(t *testing.T) {
+	oracle_id := "fc2ccab7-cab1-4463-b73d-898070136d74"
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT COUNT\(DISTINCT\("cards"."oracle_id"\)\) FROM "collection_entries" JOIN cards (.+)$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT cards.oracle_id, (.+) FROM "collection_entries" JOIN cards (.+) GROUP BY "cards"."oracle_id" ORDER BY name LIMIT 30$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "name", "quantity"}).AddRow(oracle_id, "Lightning Bolt", 7))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/collection/summary", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response OracleSummaryResult
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Cards) != 1 || response.Cards[0].Quantity != 7 {
+		t.Fatalf("Expected 7 Lightning Bolts across all printings, got %+v", response.Cards)
+	}
+}
+
+func TestCollectionSummaryFiltered(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT COUNT(.+) WHERE collection_entries.user_id = \$1 AND collection_entries.location_id = \$2 AND \(EXISTS (.+) AND entry_tags.name = \$3 \)\) (.+)$`).WithArgs(1, 2, "for-trade").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(`^SELECT cards.oracle_id, (.+) AND collection_entries.location_id = \$2 AND \(EXISTS (.+) LIMIT 30$`).WithArgs(1, 2, "for-trade").WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "name", "quantity"}))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/collection/summary?location_id=2&tag=For-Trade", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionValue(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT sets.code, sets.name, SUM\(collection_entries.quantity \* COALESCE\((.+)cards.price_eur_foil(.+) GROUP BY sets.code, sets.name ORDER BY value desc$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"code", "name", "value"}).AddRow("m10", "Magic 2010", 12.5).AddRow("con", "Conflux", 0.5))
+	mock.ExpectQuery(`^SELECT collection_entries.card_id, (.+) ORDER BY price desc LIMIT 1$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"card_id", "finish", "quantity", "price", "value"}).AddRow(mulldrifter_id, "foil", 2, 5.25, 10.5))
+	mock.ExpectQuery(`^SELECT \* FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(mulldrifter_id, "Mulldrifter"))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/collection/value?currency=EUR&top=1", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cards unmarshal from scryfall's format rather than ours
+	var response struct {
+		Total float64
+		Top []struct {
+			Card struct {
+				Name string
+			}
+		}
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Total != 13 {
+		t.Fatalf("Expected total value of 13, got %f", response.Total)
+	} else if len(response.Top) != 1 || response.Top[0].Card.Name != "Mulldrifter" {
+		t.Fatalf("Expected Mulldrifter to be the most valuable card, got %+v", response.Top)
+	}
+}
+
+func TestCollectionValueUnknownCurrency(t *testing.T) {
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/collection/value?currency=doubloons", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrUnknownCurrency.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionMovers(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT collection_entries.card_id, (.+) JOIN LATERAL \((.+)\) AS earlier ON true WHERE (.+) ORDER BY total_change desc LIMIT 10$`).WithArgs(AnyTime{}, 1).WillReturnRows(sqlmock.NewRows([]string{"card_id", "finish", "quantity", "previous_price", "current_price", "change", "percent_change", "total_change"}).AddRow(mulldrifter_id, "nonfoil", 4, 1.0, 1.5, 0.5, 50.0, 2.0))
+	mock.ExpectQuery(`^SELECT collection_entries.card_id, (.+) ORDER BY total_change asc LIMIT 10$`).WithArgs(AnyTime{}, 1).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(mulldrifter_id, "Mulldrifter"))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/collection/movers", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Gainers []struct {
+			TotalChange float64 `json:"total_change"`
+			PercentChange *float64 `json:"percent_change"`
+		}
+		Losers []struct{}
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Gainers) != 1 || response.Gainers[0].TotalChange != 2 || *response.Gainers[0].PercentChange != 50 {
+		t.Fatalf("Unexpected gainers %+v", response.Gainers)
+	} else if len(response.Losers) != 0 {
+		t.Fatalf("Expected no losers, got %d", len(response.Losers))
+	}
+}
+
+func TestCardPrices(t *testing.T) {
+	mock.ExpectQuery(`^SELECT \* FROM "price_snapshots" WHERE card_id = \$1 AND date >= \$2 (.+) ORDER BY date$`).WithArgs(mulldrifter_id, AnyTime{}).WillReturnRows(sqlmock.NewRows([]string{"card_id", "date", "price_usd"}).AddRow(mulldrifter_id, time.Now(), 0.25))
+
+	w := callEndpoint("", "GET", fmt.Sprintf("/api/cards/%s/prices", mulldrifter_id))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response PriceHistory
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Snapshots) != 1 || *response.Snapshots[0].Prices.USD != 0.25 {
+		t.Fatalf("Unexpected price history %+v", response.Snapshots)
+	}
+}
+
+func TestCollectionExport(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT collection_entries.quantity, (.+) JOIN cards ON cards.id = collection_entries.card_id JOIN sets ON sets.id = cards.set_id WHERE (.+) ORDER BY sets.code,(.+)$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"quantity", "name", "set_code", "set_name", "collector_number", "finish", "language", "condition", "scryfall_id"}).AddRow(4, "Mulldrifter", "ima", "Iconic Masters", "59", "nonfoil", "en", "near_mint", mulldrifter_id))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/collection/export?format=tcgplayer", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Quantity,Name,Set,Card Number,Set Code,Printing,Condition,Language\n" +
+	            "4,Mulldrifter,Iconic Masters,59,IMA,Normal,Near Mint,English\n"
+	if w.Body.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestCollectionExportUnknownFormat(t *testing.T) {
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/collection/export?format=spreadsheet", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrUnknownFormat.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionBatch(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "cards" WHERE id IN \(\$1,\$2\) (.+)$`).WithArgs(mulldrifter_id, black_lotus_id).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(mulldrifter_id).AddRow(black_lotus_id))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "foil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(1, 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+) ON CONFLICT (.+) DO UPDATE SET "quantity"=GREATEST\(collection_entries.quantity \+ \$11, 0\),(.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "foil", "near_mint", 0, 2, 1, 2).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "quantity"}).AddRow(1, mulldrifter_id, "foil", "near_mint", 3))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, black_lotus_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+) ON CONFLICT (.+) DO UPDATE SET "quantity"=excluded.quantity,(.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, black_lotus_id, "nonfoil", "near_mint", 0, 1, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "quantity"}).AddRow(2, black_lotus_id, "nonfoil", "near_mint", 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+
+	body := fmt.Sprintf(`[{"card_id": "%s", "finish": "foil", "quantity": 2}, {"card_id": "%s", "set": 1}]`, mulldrifter_id, black_lotus_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/batch", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result BatchResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Entries) != 2 || result.Entries[0].Quantity != 3 || result.Entries[1].Quantity != 1 {
+		t.Fatalf("Unexpected entries %+v", result.Entries)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionBatchInvalid(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "cards" WHERE id IN \(\$1,\$2\) (.+)$`).WithArgs(mulldrifter_id, black_lotus_id).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(black_lotus_id))
+
+	body := fmt.Sprintf(`[{"card_id": "%s", "quantity": 2}, {"card_id": "%s", "finish": "shiny", "quantity": 1}]`, mulldrifter_id, black_lotus_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/batch", newTestToken("test"))
+
+	err := validateCode(w, 422)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result BatchResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Errors) != 2 || result.Errors[0].Message != ErrCardNotFound.Error() || result.Errors[1].Message != ErrUnknownFinish.Error() {
+		t.Fatalf("Unexpected errors %+v", result.Errors)
+	}
+}
+
+func TestCollectionBatchIfMatchChanged(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "cards" WHERE id IN \(\$1,\$2\) (.+)$`).WithArgs(mulldrifter_id, black_lotus_id).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(mulldrifter_id).AddRow(black_lotus_id))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(2, 4))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, black_lotus_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(1, 3))
+	mock.ExpectRollback()
+
+	body := fmt.Sprintf(`[{"card_id": "%s", "set": 3, "if_match": "\"4\""}, {"card_id": "%s", "set": 0, "if_match": "\"2\""}]`, mulldrifter_id, black_lotus_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/batch", newTestToken("test"))
+
+	err := validateCode(w, 412)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result BatchResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Errors) != 1 || result.Errors[0].Index != 1 || result.Errors[0].Message != ErrEntryChanged.Error() || result.BatchID != nil {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionSetToZero(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(mulldrifter_id))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(2, 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+) DO UPDATE SET "quantity"=excluded.quantity,(.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "nonfoil", "near_mint", 0, 0, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "quantity"}).AddRow(7, mulldrifter_id, "nonfoil", "near_mint", 0))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectExec(`^DELETE FROM "collection_entries" WHERE "collection_entries"."id" = \$1$`).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body := fmt.Sprintf(`{"card_id": "%s", "quantity": 0}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/set", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionUpdateUnknownCard(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(black_lotus_id).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	body := fmt.Sprintf(`{"card_id": "%s", "quantity": 1}`, black_lotus_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/update", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrCardNotFound.Error()}
+	err := validateErrorResponse(w, 404, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionRemove(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^DELETE FROM "collection_entries" WHERE user_id = \$1 AND card_id = \$2 AND finish = \$3 AND condition = \$4 AND location_id = \$5 RETURNING (.+)$`).WithArgs(1, mulldrifter_id, "foil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"id", "quantity"}))
+	mock.ExpectRollback()
+
+	body := fmt.Sprintf(`{"card_id": "%s", "finish": "foil"}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/remove", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrEntryNotFound.Error()}
+	err := validateErrorResponse(w, 404, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionSetIfMatch(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(mulldrifter_id))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(2, 4))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(2, 4))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+) DO UPDATE SET "quantity"=excluded.quantity,"version"=collection_entries.version \+ 1 (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "nonfoil", "near_mint", 0, 3, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "quantity", "version"}).AddRow(7, mulldrifter_id, "nonfoil", "near_mint", 3, 5))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	body := fmt.Sprintf(`{"card_id": "%s", "quantity": 3}`, mulldrifter_id)
+	w := callEndpointWithIfMatch(body, "POST", "/api/test/collection/set", newTestToken("test"), `"4"`)
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Header().Get("ETag") != `"5"` {
+		t.Fatalf("Expected ETag \"5\", got %s", w.Header().Get("ETag"))
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionSetIfMatchChanged(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(mulldrifter_id))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(2, 5))
+	mock.ExpectRollback()
+
+	body := fmt.Sprintf(`{"card_id": "%s", "quantity": 3}`, mulldrifter_id)
+	w := callEndpointWithIfMatch(body, "POST", "/api/test/collection/set", newTestToken("test"), `"4"`)
+
+	errorResponse := ErrorResponse{Message: ErrEntryChanged.Error()}
+	err := validateErrorResponse(w, 412, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateLocationDuplicate(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^INSERT INTO "locations" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, "Trade binder").WillReturnError(gorm.ErrDuplicatedKey)
+	mock.ExpectRollback()
+
+	w := callEndpointWithCookieAuth(`{"name": " Trade binder "}`, "POST", "/api/test/locations", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrLocationExists.Error()}
+	err := validateErrorResponse(w, 409, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteLocationNotEmpty(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT count\(\*\) FROM "collection_entries" WHERE user_id = \$1 AND location_id = \$2 (.+)$`).WithArgs(1, 3).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectRollback()
+
+	w := callEndpointWithCookieAuth("", "DELETE", "/api/test/locations/3", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrLocationNotEmpty.Error()}
+	err := validateErrorResponse(w, 409, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionMove(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "locations" WHERE user_id = \$1 AND id IN \(\$2\) (.+)$`).WithArgs(1, 3).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(4, 2))
+	mock.ExpectQuery(`^SELECT "name" FROM "entry_tags" WHERE collection_entry_id IN \(SELECT "id" FROM "collection_entries" WHERE user_id = \$1 AND card_id = \$2 AND finish = \$3 AND condition = \$4 AND location_id = \$5 (.+)\) (.+)$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("for-trade"))
+	mock.ExpectQuery(`^SELECT deck_allocations.id AS allocation_id, (.+) WHERE deck_allocations.collection_entry_id IN \(SELECT "id" FROM "collection_entries" WHERE (.+)\) (.+) ORDER BY deck_allocations.id desc FOR UPDATE OF "deck_allocations"$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"allocation_id", "deck_id", "deck", "card_id", "claimed"}).AddRow(9, 2, "Mill", mulldrifter_id, 2))
+	mock.ExpectExec(`^UPDATE "deck_allocations" SET "quantity"=quantity - \$1,"updated_at"=\$2 WHERE id = \$3 (.+)$`).WithArgs(1, AnyTime{}, 9).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(4, 2))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "nonfoil", "near_mint", 0, -3, 1, -3).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "location_id", "quantity", "version"}).AddRow(1, mulldrifter_id, "nonfoil", "near_mint", 0, 1, 3))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 3).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "nonfoil", "near_mint", 3, 3, 1, 3).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "location_id", "quantity", "version"}).AddRow(2, mulldrifter_id, "nonfoil", "near_mint", 3, 3, 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(`^INSERT INTO "entry_tags" (.+) ON CONFLICT DO NOTHING RETURNING "id"$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, 2, "for-trade").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^INSERT INTO "deck_allocations" (.+) ON CONFLICT \("deck_id","collection_entry_id"\) DO UPDATE SET "quantity"=deck_allocations.quantity \+ excluded.quantity,"updated_at"=excluded.updated_at RETURNING (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, 2, 2, 1).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10))
+	mock.ExpectCommit()
+
+	// The entry is only locked once even with If-Match set
+	body := fmt.Sprintf(`{"card_id": "%s", "to_location_id": 3, "quantity": 3}`, mulldrifter_id)
+	w := callEndpointWithIfMatch(body, "POST", "/api/test/collection/move", newTestToken("test"), `"2"`)
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result MoveResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.From.Quantity != 1 || result.To.Quantity != 3 || result.To.LocationID != 3 {
+		t.Fatalf("Unexpected move %+v", result)
+	}
+	// One of the Mill deck's two copies had to move with them
+	if len(result.Allocations) != 1 || result.Allocations[0].Deck != "Mill" || result.Allocations[0].Claimed != 2 || result.Allocations[0].Taken != 1 {
+		t.Fatalf("Unexpected allocations %+v", result.Allocations)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionMoveNotEnough(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "locations" WHERE user_id = \$1 AND id IN \(\$2\) (.+)$`).WithArgs(1, 3).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 3).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(1, 1))
+	mock.ExpectRollback()
+
+	body := fmt.Sprintf(`{"card_id": "%s", "location_id": 3, "quantity": 2}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/move", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrNotEnoughToMove.Error()}
+	err := validateErrorResponse(w, 422, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionMoveIfMatchChanged(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "locations" WHERE user_id = \$1 AND id IN \(\$2\) (.+)$`).WithArgs(1, 3).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(4, 3))
+	mock.ExpectRollback()
+
+	body := fmt.Sprintf(`{"card_id": "%s", "to_location_id": 3, "quantity": 3}`, mulldrifter_id)
+	w := callEndpointWithIfMatch(body, "POST", "/api/test/collection/move", newTestToken("test"), `"2"`)
+
+	errorResponse := ErrorResponse{Message: ErrEntryChanged.Error()}
+	err := validateErrorResponse(w, 412, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionTag(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "collection_entries" WHERE user_id = \$1 AND card_id = \$2 AND finish = \$3 AND condition = \$4 AND location_id = \$5 (.+) LIMIT 1$`).WithArgs(1, mulldrifter_id, "foil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^INSERT INTO "entry_tags" (.+) ON CONFLICT DO NOTHING RETURNING "id"$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, 4, "for-trade", AnyTime{}, AnyTime{}, nil, 1, 4, "signed").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	body := fmt.Sprintf(`{"entries": [{"card_id": "%s", "finish": "foil"}], "tags": ["For-Trade", " signed"]}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/tag", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionTagMissingEntry(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "id" FROM "collection_entries" (.+)$`).WithArgs(1, black_lotus_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	body := fmt.Sprintf(`{"entries": [{"card_id": "%s"}], "tags": ["cube"]}`, black_lotus_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/untag", newTestToken("test"))
+
+	err := validateCode(w, 422)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result TagResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Errors) != 1 || result.Errors[0].Message != ErrEntryNotFound.Error() {
+		t.Fatalf("Unexpected errors %+v", result.Errors)
+	}
+}
+
+func TestTags(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT entry_tags.name, (.+) FROM "entry_tags" JOIN collection_entries (.+) GROUP BY "entry_tags"."name" ORDER BY entry_tags.name$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"name", "entries", "quantity"}).AddRow("cube", 2, 2).AddRow("for-trade", 1, 4))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/tags", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tags []TagSummary
+	err = json.NewDecoder(w.Result().Body).Decode(&tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tags) != 2 || tags[1].Name != "for-trade" || tags[1].Quantity != 4 {
+		t.Fatalf("Unexpected tags %+v", tags)
+	}
+}
+
+func TestWishlistSatisfied(t *testing.T) {
+	oracle_id := "fc2ccab7-cab1-4463-b73d-898070136d74"
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT wishlist_items.\*, COALESCE\((.+)\) AS owned FROM "wishlist_items" WHERE wishlist_items.user_id = \$1 (.+) ORDER BY wishlist_items.id$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "oracle_id", "quantity", "finish", "currency", "owned"}).AddRow(1, mulldrifter_id, nil, 4, "foil", "usd", 4).AddRow(2, nil, oracle_id, 2, "", "usd", 1))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/wishlist/satisfied", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var statuses []WishlistStatus
+	err = json.NewDecoder(w.Result().Body).Decode(&statuses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statuses) != 1 || statuses[0].ID != 1 || !statuses[0].Satisfied || statuses[0].Owned != 4 {
+		t.Fatalf("Expected only the first item to be satisfied, got %+v", statuses)
+	}
+}
+
+func TestCreateWishlistItem(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT count\(\*\) FROM "cards" WHERE id = \$1 (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^INSERT INTO "wishlist_items" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, nil, 1, "", "usd", 2.5).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+
+	body := fmt.Sprintf(`{"card_id": "%s", "max_price": 2.5}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/wishlist", newTestToken("test"))
+
+	err := validateCode(w, 201)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var item models.WishlistItem
+	err = json.NewDecoder(w.Result().Body).Decode(&item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.ID != 3 || item.Quantity != 1 || item.Currency != "usd" {
+		t.Fatalf("Unexpected item %+v", item)
+	}
+}
+
+func TestCreateWishlistItemWithCardAndOracle(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	body := fmt.Sprintf(`{"card_id": "%s", "oracle_id": "%s"}`, mulldrifter_id, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/wishlist", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrInvalidWishlistCard.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTradeMatches(t *testing.T) {
+	mulldrifter_oracle_id := "fc2ccab7-cab1-4463-b73d-898070136d74"
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT users.id, users.username, trade_settings.keep FROM "trade_settings" JOIN users (.+) WHERE trade_settings.opt_in = \$1 AND users.id <> \$2 AND users.username = \$3 (.+)$`).WithArgs(true, 1, "alice").WillReturnRows(sqlmock.NewRows([]string{"id", "username", "keep"}).AddRow(2, "alice", 0))
+	mock.ExpectQuery(`^SELECT \* FROM "trade_settings" WHERE user_id = \$1 (.+) LIMIT 1$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"user_id", "opt_in", "keep"}).AddRow(1, true, 4))
+	mock.ExpectQuery(`^SELECT collection_entries.card_id, cards.oracle_id, (.+) GROUP BY (.+)$`).WithArgs(4, 4, 1).WillReturnRows(sqlmock.NewRows([]string{"card_id", "oracle_id", "finish", "quantity", "price_usd_foil"}).AddRow(mulldrifter_id, mulldrifter_oracle_id, "foil", 2, 3.0))
+	mock.ExpectQuery(`^SELECT wishlist_items.\*, (.+)$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "quantity", "finish", "currency", "owned"}).AddRow(1, black_lotus_id, 1, "", "usd", 0))
+	mock.ExpectQuery(`^SELECT collection_entries.card_id, cards.oracle_id, (.+) GROUP BY (.+)$`).WithArgs(0, 0, 2).WillReturnRows(sqlmock.NewRows([]string{"card_id", "oracle_id", "finish", "quantity", "price_usd"}).AddRow(black_lotus_id, black_lotus_id, "nonfoil", 1, 100.0))
+	mock.ExpectQuery(`^SELECT wishlist_items.\*, (.+)$`).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"id", "oracle_id", "quantity", "finish", "currency", "owned"}).AddRow(2, mulldrifter_oracle_id, 4, "", "usd", 1))
+	mock.ExpectQuery(`^SELECT \* FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(black_lotus_id).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(black_lotus_id, "Black Lotus"))
+	mock.ExpectQuery(`^SELECT \* FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(mulldrifter_id, "Mulldrifter"))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/trade/matches?with=alice", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type offer struct {
+		Card struct {
+			Name string `json:"name"`
+		} `json:"card"`
+		Quantity int `json:"quantity"`
+	}
+	var matches []struct {
+		Receive []offer `json:"receive"`
+		Give []offer `json:"give"`
+		GiveValue float64 `json:"give_value"`
+		Balance float64 `json:"balance"`
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&matches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(matches) != 1 || len(matches[0].Receive) != 1 || len(matches[0].Give) != 1 {
+		t.Fatalf("Unexpected matches %+v", matches)
+	}
+	match := matches[0]
+	if match.Receive[0].Card.Name != "Black Lotus" || match.Give[0].Quantity != 2 || match.GiveValue != 6 || match.Balance != 94 {
+		t.Fatalf("Unexpected match %+v", match)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTradeMatchesNotOptedIn(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT users.id, (.+) FROM "trade_settings" (.+)$`).WithArgs(true, 1, "alice").WillReturnRows(sqlmock.NewRows([]string{"id", "username", "keep"}))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/trade/matches?with=alice", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrNotTrading.Error()}
+	err := validateErrorResponse(w, 404, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTradeProposalAccept(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT \* FROM "trade_proposals" WHERE id = \$1 AND \(proposer_id = \$2 OR recipient_id = \$3\) (.+) FOR UPDATE$`).WithArgs(5, 1, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "proposer_id", "recipient_id", "state"}).AddRow(5, 2, 1, "pending"))
+	mock.ExpectQuery(`^SELECT \* FROM "trade_items" WHERE trade_proposal_id = \$1 (.+) ORDER BY id$`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"id", "trade_proposal_id", "direction", "card_id", "finish", "condition", "location_id", "quantity"}).AddRow(1, 5, "give", mulldrifter_id, "nonfoil", "near_mint", 0, 1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(2, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(2, 1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(2, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(2, 1))
+	mock.ExpectQuery(`^SELECT deck_allocations.id AS allocation_id, (.+) FOR UPDATE OF "deck_allocations"$`).WithArgs(2, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"allocation_id"}))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(2, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(2, 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 2, mulldrifter_id, "nonfoil", "near_mint", 0, -1, 1, -1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "location_id", "quantity", "version"}).AddRow(1, mulldrifter_id, "nonfoil", "near_mint", 0, 1, 2))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "nonfoil", "near_mint", 0, 1, 1, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "location_id", "quantity", "version"}).AddRow(2, mulldrifter_id, "nonfoil", "near_mint", 0, 1, 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectExec(`^UPDATE "trade_proposals" SET (.+) WHERE (.+)$`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`^SELECT "id","username" FROM "users" WHERE id IN \(\$1,\$2\) (.+)$`).WithArgs(2, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "test").AddRow(2, "alice"))
+
+	w := callEndpointWithCookieAuth("", "POST", "/api/test/trade/proposals/5/accept", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var proposal models.TradeProposal
+	err = json.NewDecoder(w.Result().Body).Decode(&proposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if proposal.State != "accepted" || proposal.BatchID == nil || proposal.Proposer != "alice" || proposal.Recipient != "test" {
+		t.Fatalf("Unexpected proposal %+v", proposal)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTradeProposalAcceptReleasesClaims(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT \* FROM "trade_proposals" WHERE id = \$1 AND \(proposer_id = \$2 OR recipient_id = \$3\) (.+) FOR UPDATE$`).WithArgs(5, 1, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "proposer_id", "recipient_id", "state"}).AddRow(5, 2, 1, "pending"))
+	mock.ExpectQuery(`^SELECT \* FROM "trade_items" WHERE trade_proposal_id = \$1 (.+) ORDER BY id$`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"id", "trade_proposal_id", "direction", "card_id", "finish", "condition", "location_id", "quantity"}).AddRow(1, 5, "receive", mulldrifter_id, "nonfoil", "near_mint", 0, 1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(1, 1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(1, 1))
+	mock.ExpectQuery(`^SELECT deck_allocations.id AS allocation_id, (.+) FOR UPDATE OF "deck_allocations"$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"allocation_id", "deck_id", "deck", "card_id", "claimed"}).AddRow(9, 2, "Mill", mulldrifter_id, 1))
+	// The claim is given up before the entry goes, rather than going with it
+	mock.ExpectExec(`^DELETE FROM "deck_allocations" WHERE "deck_allocations"."id" = \$1$`).WithArgs(9).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(1, 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "nonfoil", "near_mint", 0, -1, 1, -1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "location_id", "quantity", "version"}).AddRow(1, mulldrifter_id, "nonfoil", "near_mint", 0, 0, 2))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(`^DELETE FROM "collection_entries" WHERE "collection_entries"."id" = \$1$`).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(2, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 2, mulldrifter_id, "nonfoil", "near_mint", 0, 1, 1, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "location_id", "quantity", "version"}).AddRow(2, mulldrifter_id, "nonfoil", "near_mint", 0, 1, 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectExec(`^UPDATE "trade_proposals" SET (.+) WHERE (.+)$`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`^SELECT "id","username" FROM "users" WHERE id IN \(\$1,\$2\) (.+)$`).WithArgs(2, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "test").AddRow(2, "alice"))
+
+	w := callEndpointWithCookieAuth("", "POST", "/api/test/trade/proposals/5/accept", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		State string
+		Allocations []AffectedAllocation
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.State != "accepted" || len(result.Allocations) != 1 || result.Allocations[0].Deck != "Mill" || result.Allocations[0].Taken != 1 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTradeProposalAffectedAllocations(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT \* FROM "trade_proposals" WHERE id = \$1 AND \(proposer_id = \$2 OR recipient_id = \$3\) (.+) LIMIT 1$`).WithArgs(5, 1, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "proposer_id", "recipient_id", "state"}).AddRow(5, 2, 1, "pending"))
+	mock.ExpectQuery(`^SELECT \* FROM "trade_items" WHERE "trade_items"."trade_proposal_id" = \$1 (.+)$`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"id", "trade_proposal_id", "direction", "card_id", "finish", "condition", "location_id", "quantity"}).AddRow(1, 5, "receive", mulldrifter_id, "nonfoil", "near_mint", 0, 2))
+	// Only a preview, so nothing is locked
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) LIMIT 1$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(3, 1))
+	mock.ExpectQuery(`^SELECT deck_allocations.id AS allocation_id, (.+) ORDER BY deck_allocations.id desc$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"allocation_id", "deck_id", "deck", "card_id", "claimed"}).AddRow(9, 2, "Mill", mulldrifter_id, 1).AddRow(8, 3, "Flicker", mulldrifter_id, 2))
+	mock.ExpectQuery(`^SELECT "id","username" FROM "users" WHERE id IN \(\$1,\$2\) (.+)$`).WithArgs(2, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "test").AddRow(2, "alice"))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/trade/proposals/5", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Allocations []AffectedAllocation
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Giving away 2 of 3 copies leaves one for the three claimed,
+	// the newest claim gives its copy up first
+	if len(result.Allocations) != 2 || result.Allocations[0].Deck != "Mill" || result.Allocations[0].Taken != 1 ||
+	   result.Allocations[1].Deck != "Flicker" || result.Allocations[1].Taken != 1 {
+		t.Fatalf("Unexpected allocations %+v", result.Allocations)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTradeProposalAcceptDeclined(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT \* FROM "trade_proposals" (.+) FOR UPDATE$`).WithArgs(5, 1, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "proposer_id", "recipient_id", "state"}).AddRow(5, 2, 1, "declined"))
+	mock.ExpectQuery(`^SELECT \* FROM "trade_items" (.+)$`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	w := callEndpointWithCookieAuth("", "POST", "/api/test/trade/proposals/5/accept", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: "Can't accept a proposal that's declined"}
+	err := validateErrorResponse(w, 409, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTradeProposalCancelNotProposer(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT \* FROM "trade_proposals" (.+) FOR UPDATE$`).WithArgs(5, 1, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "proposer_id", "recipient_id", "state"}).AddRow(5, 2, 1, "pending"))
+	mock.ExpectQuery(`^SELECT \* FROM "trade_items" (.+)$`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	w := callEndpointWithCookieAuth("", "POST", "/api/test/trade/proposals/5/cancel", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: trades.ErrNotProposer.Error()}
+	err := validateErrorResponse(w, 403, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateTradeProposalNotTrading(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT "users"."id" FROM "trade_settings" JOIN users (.+)$`).WithArgs(true, "alice").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	body := fmt.Sprintf(`{"to": "alice", "give": [{"card_id": "%s", "quantity": 1}]}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/trade/proposals", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrNotTrading.Error()}
+	err := validateErrorResponse(w, 404, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateTradeProposalEmpty(t *testing.T) {
+	w := callEndpointWithCookieAuth(`{"to": "alice"}`, "POST", "/api/test/trade/proposals", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrInvalidProposal.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateDeck(t *testing.T) {
+	mulldrifter_oracle_id := "fc2ccab7-cab1-4463-b73d-898070136d74"
+	mock.ExpectQuery(`^SELECT "id","oracle_id" FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id", "oracle_id"}).AddRow(mulldrifter_id, mulldrifter_oracle_id))
+	mock.ExpectQuery(`^SELECT "id" FROM "oracle_cards" WHERE id IN \(\$1,\$2\) (.+)$`).WithArgs(mulldrifter_oracle_id, mulldrifter_oracle_id).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(mulldrifter_oracle_id))
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^INSERT INTO "decks" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, "Mulldrifter Tribal", "").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec(`^DELETE FROM "deck_cards" WHERE deck_id = \$1$`).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`^INSERT INTO "deck_cards" (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 7, mulldrifter_oracle_id, "main", 4, AnyTime{}, AnyTime{}, nil, 7, mulldrifter_oracle_id, "side", 1).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`^SELECT \* FROM "decks" WHERE id = \$1 AND user_id = \$2 (.+)$`).WithArgs(7, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(7, "Mulldrifter Tribal"))
+	mock.ExpectQuery(`^SELECT deck_cards.\*, oracle_cards.name FROM "deck_cards" LEFT JOIN oracle_cards (.+) ORDER BY deck_cards.id$`).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "zone", "quantity", "name"}).AddRow(mulldrifter_oracle_id, "main", 4, "Mulldrifter").AddRow(mulldrifter_oracle_id, "side", 1, "Mulldrifter"))
+
+	// The same card twice in one zone is added together
+	body := fmt.Sprintf(`{"name": " Mulldrifter Tribal ", "cards": [
+		{"card_id": "%s", "quantity": 3},
+		{"oracle_id": "%s", "quantity": 1},
+		{"oracle_id": "%s", "zone": "side", "quantity": 1}
+	]}`, mulldrifter_id, mulldrifter_oracle_id, mulldrifter_oracle_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/decks", newTestToken("test"))
+
+	err := validateCode(w, 201)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deck models.Deck
+	err = json.NewDecoder(w.Result().Body).Decode(&deck)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deck.ID != 7 || len(deck.Cards) != 2 || deck.Cards[0].Name != "Mulldrifter" {
+		t.Fatalf("Unexpected deck %+v", deck)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateDeckUnknownZone(t *testing.T) {
+	body := fmt.Sprintf(`{"name": "Sideboard Tech", "cards": [{"card_id": "%s", "zone": "graveyard", "quantity": 1}]}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/decks", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrUnknownZone.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeckOwnership(t *testing.T) {
+	mulldrifter_oracle_id := "fc2ccab7-cab1-4463-b73d-898070136d74"
+	black_lotus_oracle_id := "5089ec1a-f881-4d55-af14-5d996171203b"
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT \* FROM "decks" WHERE id = \$1 AND user_id = \$2 (.+)$`).WithArgs(7, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(7, "Mulldrifter Tribal"))
+	mock.ExpectQuery(`^SELECT deck_cards.\*, oracle_cards.name FROM "deck_cards" (.+)$`).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "zone", "quantity", "name"}).AddRow(mulldrifter_oracle_id, "main", 4, "Mulldrifter").AddRow(black_lotus_oracle_id, "maybe", 1, "Black Lotus"))
+	mock.ExpectQuery(`^SELECT cards.oracle_id, SUM\(collection_entries.quantity\) AS quantity FROM "collection_entries" JOIN cards (.+) GROUP BY "cards"."oracle_id"$`).WithArgs(mulldrifter_oracle_id, black_lotus_oracle_id, 1).WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "quantity"}).AddRow(mulldrifter_oracle_id, 3))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/decks/7/ownership", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ownership DeckOwnership
+	err = json.NewDecoder(w.Result().Body).Decode(&ownership)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ownership.Cards) != 1 || ownership.Needed != 4 || ownership.Missing != 1 || ownership.Complete {
+		t.Fatalf("Unexpected ownership %+v", ownership)
+	}
+}
+
+func TestDeckLegality(t *testing.T) {
+	mulldrifter_oracle_id := "fc2ccab7-cab1-4463-b73d-898070136d74"
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT \* FROM "decks" WHERE id = \$1 AND user_id = \$2 (.+)$`).WithArgs(7, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "format"}).AddRow(7, "Mulldrifter Tribal", "pauper"))
+	mock.ExpectQuery(`^SELECT deck_cards.\*, oracle_cards.name FROM "deck_cards" (.+)$`).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "zone", "quantity", "name"}).AddRow(mulldrifter_oracle_id, "main", 60, "Mulldrifter"))
+	mock.ExpectQuery(`^SELECT DISTINCT ON \(oracle_id\) cards.\* FROM "cards" WHERE oracle_id IN \(\$1\) (.+) ORDER BY oracle_id,(.+)$`).WithArgs(mulldrifter_oracle_id).WillReturnRows(sqlmock.NewRows([]string{"id", "oracle_id", "name", "type_line"}).AddRow(mulldrifter_id, mulldrifter_oracle_id, "Mulldrifter", "Creature — Elemental"))
+	mock.ExpectQuery(`^SELECT \* FROM "faces" (.+)$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "legalities" (.+)$`).WithArgs(mulldrifter_id, "vintage").WillReturnRows(sqlmock.NewRows([]string{"card_id", "format", "status"}).AddRow(mulldrifter_id, "vintage", "legal"))
+
+	// The format in the query wins over the deck's
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/decks/7/legality?format=vintage", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var legality struct {
+		Format string `json:"format"`
+		Legal bool `json:"legal"`
+		Cards []struct {
+			Name string `json:"name"`
+			Violations []struct {
+				Rule string `json:"rule"`
+			} `json:"violations"`
+		} `json:"cards"`
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&legality)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if legality.Format != "vintage" || legality.Legal || len(legality.Cards) != 1 || legality.Cards[0].Violations[0].Rule != "copies" {
+		t.Fatalf("Unexpected legality %+v", legality)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeckLegalityMissingFormat(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT \* FROM "decks" WHERE id = \$1 AND user_id = \$2 (.+)$`).WithArgs(7, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "format"}).AddRow(7, "Mulldrifter Tribal", ""))
+	mock.ExpectQuery(`^SELECT deck_cards.\*, oracle_cards.name FROM "deck_cards" (.+)$`).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "zone", "quantity"}))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/decks/7/legality", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrMissingDeckFormat.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocationReport(t *testing.T) {
+	sol_ring_oracle_id := "6ad8011d-3471-4369-9d68-b264cc027487"
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT collection_entries.\*, COALESCE\(SUM\(deck_allocations.quantity\), 0\) AS allocated FROM "collection_entries" LEFT JOIN deck_allocations (.+) HAVING collection_entries.quantity < (.+)$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "quantity", "allocated"}).AddRow(3, mulldrifter_id, "nonfoil", "near_mint", 1, 3))
+	mock.ExpectQuery(`^SELECT deck_allocations.collection_entry_id, (.+) WHERE deck_allocations.collection_entry_id IN \(\$1\) (.+)$`).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"collection_entry_id", "deck_id", "deck", "quantity"}).AddRow(3, 1, "Atraxa", 1).AddRow(3, 2, "Kenrith", 1).AddRow(3, 3, "Niv-Mizzet", 1))
+	mock.ExpectQuery(`^SELECT deck_cards.oracle_id, (.+) FROM "deck_cards" JOIN decks (.+)$`).WithArgs(1, "maybe").WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "name", "deck_id", "deck", "quantity"}).AddRow(sol_ring_oracle_id, "Sol Ring", 1, "Atraxa", 1).AddRow(sol_ring_oracle_id, "Sol Ring", 2, "Kenrith", 1).AddRow(sol_ring_oracle_id, "Sol Ring", 3, "Niv-Mizzet", 1))
+	mock.ExpectQuery(`^SELECT cards.oracle_id, SUM\(collection_entries.quantity\) AS quantity (.+)$`).WithArgs(sol_ring_oracle_id, 1).WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "quantity"}).AddRow(sol_ring_oracle_id, 1))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/allocations", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report struct {
+		OverAllocated []struct {
+			Free int `json:"free"`
+			Decks []DeckClaim `json:"decks"`
+		} `json:"over_allocated"`
+		Short []Shortage `json:"short"`
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.OverAllocated) != 1 || report.OverAllocated[0].Free != -2 || len(report.OverAllocated[0].Decks) != 3 {
+		t.Fatalf("Unexpected over-allocated entries %+v", report.OverAllocated)
+	}
+	if len(report.Short) != 1 || report.Short[0].Name != "Sol Ring" || report.Short[0].Needed != 3 || report.Short[0].Owned != 1 {
+		t.Fatalf("Unexpected shortages %+v", report.Short)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateToDeckNotInDeck(t *testing.T) {
+	mulldrifter_oracle_id := "fc2ccab7-cab1-4463-b73d-898070136d74"
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT \* FROM "decks" WHERE id = \$1 AND user_id = \$2 (.+)$`).WithArgs(7, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(7, "Power"))
+	mock.ExpectQuery(`^SELECT deck_cards.\*, oracle_cards.name FROM "deck_cards" (.+)$`).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"oracle_id", "zone", "quantity"}).AddRow(black_lotus_id, "main", 1))
+	mock.ExpectQuery(`^SELECT collection_entries.id, cards.oracle_id FROM "collection_entries" JOIN cards (.+) LIMIT 1$`).WithArgs(1, mulldrifter_id, "nonfoil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"id", "oracle_id"}).AddRow(3, mulldrifter_oracle_id))
+
+	body := fmt.Sprintf(`{"entries": [{"card_id": "%s", "quantity": 1}]}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/decks/7/allocations", newTestToken("test"))
+
+	err := validateCode(w, 422)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result AllocationResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Errors) != 1 || result.Errors[0].Message != ErrCardNotInDeck.Error() {
+		t.Fatalf("Unexpected errors %+v", result.Errors)
+	}
+}
+
+func TestCollectionHistory(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT count\(\*\) FROM "collection_changes" WHERE user_id = \$1 AND card_id = \$2 (.+)$`).WithArgs(1, mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(`^SELECT \* FROM "collection_changes" WHERE user_id = \$1 AND card_id = \$2 (.+) ORDER BY id desc LIMIT 30$`).WithArgs(1, mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "actor_id", "card_id", "finish", "condition", "delta", "source"}).AddRow(2, 1, 1, mulldrifter_id, "foil", "near_mint", -1, "manual").AddRow(1, 1, 1, mulldrifter_id, "foil", "near_mint", 3, "import"))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/collection/history?card_id=" + mulldrifter_id, newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result HistoryResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Total != 2 || len(result.Changes) != 2 || result.Changes[0].Delta != -1 || result.Changes[1].Source != models.ChangeSourceImport {
+		t.Fatalf("Unexpected history %+v", result)
+	}
+}
+
+func TestCollectionRevert(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT \* FROM "collection_changes" WHERE collection_changes.user_id = \$1 AND collection_changes.id = \$2 AND NOT EXISTS (.+) ORDER BY id desc$`).WithArgs(1, 5).WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "actor_id", "card_id", "finish", "condition", "delta", "source"}).AddRow(5, 1, 1, mulldrifter_id, "foil", "near_mint", 3, "manual"))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "foil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(4, 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+) DO UPDATE SET "quantity"=GREATEST(.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "foil", "near_mint", 0, -3, 1, -3).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "quantity"}).AddRow(3, mulldrifter_id, "foil", "near_mint", 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(6))
+	mock.ExpectCommit()
+
+	w := callEndpointWithCookieAuth(`{"change_id": 5}`, "POST", "/api/test/collection/revert", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result RevertResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Entries) != 1 || result.Entries[0].Quantity != 1 {
+		t.Fatalf("Unexpected entries %+v", result.Entries)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionRevertTrade(t *testing.T) {
+	batch_id := "0c7a3f52-8f0e-4d8e-9a43-6f6b6f3c2b11"
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT \* FROM "collection_changes" WHERE collection_changes.user_id = \$1 AND collection_changes.batch_id = \$2 AND NOT EXISTS (.+) ORDER BY id desc$`).WithArgs(1, batch_id).WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "actor_id", "card_id", "finish", "condition", "delta", "source"}).AddRow(7, 1, 2, mulldrifter_id, "nonfoil", "near_mint", -2, "trade"))
+	mock.ExpectRollback()
+
+	body := fmt.Sprintf(`{"batch_id": "%s"}`, batch_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/revert", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrTradeRevert.Error()}
+	err := validateErrorResponse(w, 409, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionRevertBoth(t *testing.T) {
+	body := fmt.Sprintf(`{"change_id": 5, "batch_id": "%s"}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/revert", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrInvalidRevert.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionRevertIfMatchChanged(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT \* FROM "collection_changes" WHERE collection_changes.user_id = \$1 AND collection_changes.id = \$2 AND NOT EXISTS (.+) ORDER BY id desc$`).WithArgs(1, 5).WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "actor_id", "card_id", "finish", "condition", "delta", "source"}).AddRow(5, 1, 1, mulldrifter_id, "foil", "near_mint", 3, "manual"))
+	mock.ExpectQuery(`^SELECT "quantity","version" FROM "collection_entries" WHERE (.+) FOR UPDATE$`).WithArgs(1, mulldrifter_id, "foil", "near_mint", 0).WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(5, 2))
+	mock.ExpectRollback()
+
+	body := fmt.Sprintf(`{"change_id": 5, "if_match": [{"card_id": "%s", "finish": "foil", "if_match": "\"1\""}]}`, mulldrifter_id)
+	w := callEndpointWithCookieAuth(body, "POST", "/api/test/collection/revert", newTestToken("test"))
+
+	err := validateCode(w, 412)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result RevertResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Errors) != 1 || result.Errors[0].Index != 0 || len(result.Entries) != 0 || result.BatchID != nil {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionExportText(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT cards.name, (.+) GROUP BY (.+) ORDER BY sets.code,(.+)$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"name", "set_code", "collector_number", "finish", "quantity"}).AddRow("Mulldrifter", "ima", "59", "foil", 4).AddRow("Fire // Ice", "mh2", "290", "nonfoil", 1))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/collection/export?format=text", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "4 Mulldrifter (IMA) 59 *F*\n" +
+	            "1 Fire // Ice (MH2) 290\n"
+	if w.Body.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestCollectionImportDryRun(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT (.+) FROM "cards" WHERE cards.id = \$1 (.+) LIMIT 1$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "collector_number"}).AddRow(mulldrifter_id, "Mulldrifter", "59"))
+	mock.ExpectQuery(`^SELECT \* FROM "faces" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "finishes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id", "name"}).AddRow(mulldrifter_id, "nonfoil"))
+	mock.ExpectQuery(`^SELECT \* FROM "legalities" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "collection_entries" WHERE user_id = \$1 AND location_id = \$2 AND quantity > 0 (.+)$`).WithArgs(1, 0).WillReturnRows(sqlmock.NewRows([]string{"card_id", "finish", "condition", "quantity"}).AddRow(mulldrifter_id, "nonfoil", "near_mint", 1))
+
+	file := "Name,Set code,Set name,Collector number,Foil,Quantity,Scryfall ID,Condition,Language\n" +
+	        "Mulldrifter,IMA,Iconic Masters,59,normal,2," + mulldrifter_id + ",near_mint,en\n" +
+	        "Mulldrifter,IMA,Iconic Masters,59,normal,lots," + mulldrifter_id + ",near_mint,en\n"
+	w := callEndpointWithCookieAuth(file, "POST", "/api/test/collection/import?dryRun=true", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result ImportResult
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Format != "manabox" || result.Applied {
+		t.Fatalf("Unexpected result %+v", result)
+	} else if len(result.Changes) != 1 || result.Changes[0].Current != 1 || result.Changes[0].Quantity != 3 {
+		t.Fatalf("Unexpected changes %+v", result.Changes)
+	} else if len(result.Problems) != 1 || result.Problems[0].Line != 3 {
+		t.Fatalf("Unexpected problems %+v", result.Problems)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionImportReplaceKeepsTags(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT (.+) FROM "cards" WHERE cards.id = \$1 (.+) LIMIT 1$`).WithArgs(mulldrifter_id).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "collector_number"}).AddRow(mulldrifter_id, "Mulldrifter", "59"))
+	mock.ExpectQuery(`^SELECT \* FROM "faces" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "finishes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id", "name"}).AddRow(mulldrifter_id, "nonfoil"))
+	mock.ExpectQuery(`^SELECT \* FROM "legalities" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM "collection_entries" WHERE user_id = \$1 AND location_id = \$2 AND quantity > 0 (.+)$`).WithArgs(1, 0).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "finish", "condition", "quantity"}).AddRow(4, mulldrifter_id, "nonfoil", "near_mint", 1).AddRow(5, black_lotus_id, "nonfoil", "near_mint", 1))
+	mock.ExpectQuery(`^SELECT \* FROM "cards" WHERE id IN \(\$1\) (.+)$`).WithArgs(black_lotus_id).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(black_lotus_id, "Black Lotus"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^INSERT INTO "collection_changes" (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	// Only the entry that isn't in the import is deleted, the tagged
+	// one is updated in place so it keeps its tags
+	mock.ExpectExec(`^DELETE FROM "collection_entries" WHERE user_id = \$1 AND location_id = \$2 AND \(card_id, finish, condition\) IN \(\(\$3,\$4,\$5\)\)$`).WithArgs(1, 0, black_lotus_id, "nonfoil", "near_mint").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`^INSERT INTO "collection_entries" (.+) ON CONFLICT (.+) DO UPDATE SET "quantity"=excluded.quantity,"version"=collection_entries.version \+ 1 RETURNING (.+)$`).WithArgs(AnyTime{}, AnyTime{}, nil, 1, mulldrifter_id, "nonfoil", "near_mint", 0, 2, 1).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+	mock.ExpectCommit()
+
+	file := "Name,Set code,Set name,Collector number,Foil,Quantity,Scryfall ID,Condition,Language\n" +
+	        "Mulldrifter,IMA,Iconic Masters,59,normal,2," + mulldrifter_id + ",near_mint,en\n"
+	w := callEndpointWithCookieAuth(file, "POST", "/api/test/collection/import?mode=replace", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionImportUnknownMode(t *testing.T) {
+	w := callEndpointWithCookieAuth("", "POST", "/api/test/collection/import?mode=merge", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrUnknownImportMode.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateAlertWithCardAndOracle(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	payload := fmt.Sprintf(`{"card_id": "%s", "oracle_id": "%s", "direction": "above", "threshold": 5}`, mulldrifter_id, mulldrifter_id)
+	w := callEndpointWithCookieAuth(payload, "POST", "/api/test/alerts", newTestToken("test"))
+
+	errorResponse := ErrorResponse{Message: ErrInvalidAlertCard.Error()}
+	err := validateErrorResponse(w, 400, errorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotificationsUnread(t *testing.T) {
+	mock.ExpectQuery(`^SELECT "id" FROM "users" WHERE username = \$1 (.+)$`).WithArgs("test").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT count\(\*\) FROM "notifications" WHERE user_id = \$1 AND read = false (.+)$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`^SELECT \* FROM "notifications" WHERE user_id = \$1 AND read = false (.+) ORDER BY created_at desc,id desc LIMIT 30$`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "card_id", "message", "price"}).AddRow(1, mulldrifter_id, "Mulldrifter (nonfoil) rose above 1.00 usd, it's now 1.50 usd", 1.5))
+
+	w := callEndpointWithCookieAuth("", "GET", "/api/test/notifications?unread=true", newTestToken("test"))
+
+	err := validateCode(w, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response NotificationsResult
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Total != 1 || len(response.Notifications) != 1 || response.Notifications[0].Price != 1.5 {
+		t.Fatalf("Unexpected notifications %+v", response)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Makes a token the same way loginEndpoint does
+func newTestToken(username string) string {
+	claims := Claims{
+		StandardClaims: jwt.StandardClaims{
+			Subject: username,
+			ExpiresAt: time.Now().Add(5 * time.Minute).Unix(),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return token
+}
+
+func callEndpointWithCookieAuth(payload, method, endpoint, token string) *httptest.ResponseRecorder {
+	bodyReader := bytes.NewReader([]byte(payload))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, endpoint, bodyReader)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
+func callEndpointWithIfMatch(payload, method, endpoint, token, ifMatch string) *httptest.ResponseRecorder {
+	bodyReader := bytes.NewReader([]byte(payload))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, endpoint, bodyReader)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	req.Header.Add("If-Match", ifMatch)
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
 func callEndpointWithTokenAuth(payload, method, endpoint, token string) *httptest.ResponseRecorder {
 	bodyReader := bytes.NewReader([]byte(payload))
 
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Filters on a card's gameplay characteristics, these
+// are optional parameters to searchEndpoint
+type CardFilters struct {
+	TypeLine string
+	OracleText string
+	ManaCost string
+	// Letters from WUBRG the card must have all of,
+	// or "C" for colorless cards
+	Colors string
+	Power string
+	Toughness string
+	CMC *float64
+	MinCMC *float64
+	MaxCMC *float64
+	// Formats the card must be legal or banned in
+	LegalIn string
+	BannedIn string
+}
+
+func parseOptionalFloat(c *gin.Context, param string) (*float64, error) {
+	value := c.Query(param)
+	if value == "" {
+		return nil, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for %s: %s", param, value)
+	}
+
+	return &f, nil
+}
+
+func parseCardFilters(c *gin.Context) (CardFilters, error) {
+	filters := CardFilters{
+		TypeLine: c.Query("type"),
+		OracleText: c.Query("oracleText"),
+		ManaCost: c.Query("manaCost"),
+		Colors: strings.ToUpper(c.Query("colors")),
+		Power: c.Query("power"),
+		Toughness: c.Query("toughness"),
+		LegalIn: strings.ToLower(c.Query("legal")),
+		BannedIn: strings.ToLower(c.Query("banned")),
+	}
+
+	for _, color := range filters.Colors {
+		if !strings.ContainsRune("WUBRGC", color) {
+			return filters, fmt.Errorf("Invalid color: %c", color)
+		}
+	}
+
+	var err error
+	filters.CMC, err = parseOptionalFloat(c, "cmc")
+	if err != nil {
+		return filters, err
+	}
+	filters.MinCMC, err = parseOptionalFloat(c, "minCmc")
+	if err != nil {
+		return filters, err
+	}
+	filters.MaxCMC, err = parseOptionalFloat(c, "maxCmc")
+	if err != nil {
+		return filters, err
+	}
+
+	return filters, nil
+}
+
+// Multi-faced cards keep most of their text on their
+// faces so we check those as well as the card itself
+func cardOrFaceWhere(db *gorm.DB, condition string, value interface{}) *gorm.DB {
+	return db.Where(
+		fmt.Sprintf("cards.%[1]s OR EXISTS (SELECT 1 FROM faces WHERE faces.card_id = cards.id AND faces.%[1]s)", condition),
+		value, value)
+}
+
+func cardFiltersScope(filters CardFilters) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		result := db
+		if filters.TypeLine != "" {
+			result = result.Where("cards.type_line ILIKE ?", "%" + likeEscaper.Replace(filters.TypeLine) + "%")
+		}
+		if filters.OracleText != "" {
+			result = cardOrFaceWhere(result, "oracle_text ILIKE ?", "%" + likeEscaper.Replace(filters.OracleText) + "%")
+		}
+		if filters.ManaCost != "" {
+			result = cardOrFaceWhere(result, "mana_cost = ?", filters.ManaCost)
+		}
+		if filters.Power != "" {
+			result = cardOrFaceWhere(result, "power = ?", filters.Power)
+		}
+		if filters.Toughness != "" {
+			result = cardOrFaceWhere(result, "toughness = ?", filters.Toughness)
+		}
+
+		if filters.Colors == "C" {
+			result = result.Where("cards.colors = '[]'::jsonb")
+		} else if filters.Colors != "" {
+			colors := []string{}
+			for _, color := range strings.ReplaceAll(filters.Colors, "C", "") {
+				colors = append(colors, string(color))
+			}
+			// Error is impossible, it's a slice of strings
+			colorsJSON, _ := json.Marshal(colors)
+			result = result.Where("cards.colors @> ?::jsonb", string(colorsJSON))
+		}
+
+		if filters.CMC != nil {
+			result = result.Where("cards.cmc = ?", *filters.CMC)
+		}
+		if filters.MinCMC != nil {
+			result = result.Where("cards.cmc >= ?", *filters.MinCMC)
+		}
+		if filters.MaxCMC != nil {
+			result = result.Where("cards.cmc <= ?", *filters.MaxCMC)
+		}
+
+		// Restricted cards are still legal, you just can only have one
+		if filters.LegalIn != "" {
+			result = result.Where("EXISTS (SELECT 1 FROM legalities WHERE legalities.card_id = cards.id AND legalities.format = ? AND legalities.status IN ('legal', 'restricted'))", filters.LegalIn)
+		}
+		if filters.BannedIn != "" {
+			result = result.Where("EXISTS (SELECT 1 FROM legalities WHERE legalities.card_id = cards.id AND legalities.format = ? AND legalities.status = 'banned')", filters.BannedIn)
+		}
+
+		return result
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HistoryResult struct {
+	PagedResult
+	Changes []models.CollectionChange `json:"results"`
+}
+
+// The version of an entry a client last saw. A revert can change
+// many entries so it can't use a single If-Match header.
+type EntryMatch struct {
+	UpdateRequest
+	IfMatch string `json:"if_match"`
+}
+
+type RevertRequest struct {
+	ChangeID *uint `json:"change_id"`
+	BatchID *uuid.UUID `json:"batch_id"`
+	// Entries the revert shouldn't change if they've changed since
+	IfMatch []EntryMatch `json:"if_match"`
+}
+
+type RevertResult struct {
+	// Identifies the changes made by the revert, which can be reverted too
+	BatchID *uuid.UUID `json:"batch_id,omitempty"`
+	Entries []models.CollectionEntry `json:"entries"`
+	// The if_match entries that had changed, Index is their position in it
+	Errors []BatchError `json:"errors,omitempty"`
+}
+
+// Changes that haven't been undone by another change yet
+func unreverted(db *gorm.DB) *gorm.DB {
+	return db.Where(`NOT EXISTS (
+	                   SELECT 1 FROM collection_changes AS reverts
+	                   WHERE reverts.reverts_id = collection_changes.id
+	                 )`)
+}
+
+// Lists the changes made to a user's collection, newest first.
+// Can be narrowed down to a card or a batch with card_id and batch_id.
+func collectionHistoryEndpoint(c *gin.Context) {
+	var cardID, batchID uuid.UUID
+	var err error
+	if id := c.Query("card_id"); id != "" {
+		cardID, err = uuid.Parse(id)
+	}
+	if id := c.Query("batch_id"); err == nil && id != "" {
+		batchID, err = uuid.Parse(id)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidUUID.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	userHistory := func(db *gorm.DB) *gorm.DB {
+		result := db.Model(&models.CollectionChange{}).
+		             Where("user_id = ?", user.ID)
+		if cardID != uuid.Nil {
+			result = result.Where("card_id = ?", cardID)
+		}
+		if batchID != uuid.Nil {
+			result = result.Where("batch_id = ?", batchID)
+		}
+		return result
+	}
+
+	var count int64
+	err = db.Scopes(userHistory).
+	         Count(&count).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error counting collection history: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	changes := []models.CollectionChange{}
+	err = db.Scopes(userHistory).
+	         Order("id desc").
+	         Scopes(Paginate(c)).
+	         Find(&changes).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding collection history: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	offset, exists := c.Get("offset")
+	if !exists {
+		log.Fatal(errors.New("Couldn't find offset in context"))
+	}
+
+	c.JSON(http.StatusOK, HistoryResult{
+		PagedResult: NewPagedResult(count, offset.(int64)),
+		Changes: changes,
+	})
+}
+
+// Undoes a single change or every change from an import or batch
+// update. Undoing is itself a change, so the ledger stays append only.
+// Trades can't be undone since they changed another user's collection too.
+func revertCollectionChanges(c *gin.Context) {
+	var request RevertRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+	if (request.ChangeID == nil) == (request.BatchID == nil) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidRevert.Error()})
+		return
+	}
+	for i := range request.IfMatch {
+		err = request.IfMatch[i].validate()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+			return
+		}
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	batchID := uuid.New()
+	result := RevertResult{
+		BatchID: &batchID,
+		Entries: []models.CollectionEntry{},
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		changesQuery := tx.Model(&models.CollectionChange{}).
+		                   Scopes(unreverted).
+		                   Where("collection_changes.user_id = ?", user.ID)
+		if request.ChangeID != nil {
+			changesQuery = changesQuery.Where("collection_changes.id = ?", *request.ChangeID)
+		} else {
+			changesQuery = changesQuery.Where("collection_changes.batch_id = ?", *request.BatchID)
+		}
+
+		var matched []models.CollectionChange
+		err := changesQuery.Order("id desc").
+		                    Find(&matched).
+		                    Error
+		if err != nil {
+			return err
+		}
+		if len(matched) == 0 {
+			return ErrChangeNotFound
+		}
+
+		// The other side of a trade keeps what they got, so
+		// undoing our half would leave both of us with the copies
+		var changes []models.CollectionChange
+		for _, change := range matched {
+			if change.Source != models.ChangeSourceTrade {
+				changes = append(changes, change)
+			}
+		}
+		if len(changes) == 0 {
+			return ErrTradeRevert
+		}
+
+		for i, match := range request.IfMatch {
+			entry := match.entry(user.ID)
+			err := checkETag(tx, &entry, match.IfMatch)
+			if errors.Is(err, ErrEntryChanged) {
+				result.Errors = append(result.Errors, BatchError{Index: i, Message: err.Error()})
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(result.Errors) > 0 {
+			return ErrEntryChanged
+		}
+
+		// Copies from a location that's since been deleted go back to no location
+		var locationIDs []uint
+		for _, change := range changes {
+			locationIDs = append(locationIDs, change.LocationID)
+		}
+		locations, err := existingLocations(user.ID, locationIDs)
+		if err != nil {
+			return err
+		}
+
+		for _, change := range changes {
+			entry := models.CollectionEntry{
+				UserID: user.ID,
+				CardID: change.CardID,
+				Finish: change.Finish,
+				Condition: change.Condition,
+				Quantity: -change.Delta,
+			}
+			if locations[change.LocationID] {
+				entry.LocationID = change.LocationID
+			}
+			revert := models.CollectionChange{
+				ActorID: user.ID,
+				Source: models.ChangeSourceRevert,
+				BatchID: &batchID,
+				RevertsID: &change.ID,
+			}
+			err = addToCollection(tx, &entry, revert)
+			if err != nil {
+				return err
+			}
+			result.Entries = append(result.Entries, entry)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrChangeNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrChangeNotFound.Error()})
+		return
+	} else if errors.Is(err, ErrTradeRevert) {
+		c.JSON(http.StatusConflict, ErrorResponse{Message: ErrTradeRevert.Error()})
+		return
+	} else if errors.Is(err, ErrEntryChanged) {
+		result.BatchID = nil
+		c.JSON(http.StatusPreconditionFailed, result)
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error reverting collection changes: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
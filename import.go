@@ -0,0 +1,541 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/collectioncsv"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"github.com/toxicglados/umori-go/pkg/resolver"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Adds the imported cards to what's already in the collection
+	importModeAdd = "add"
+	// Makes the collection exactly what was imported
+	importModeReplace = "replace"
+
+	maxImportSize = 10 << 20
+)
+
+// One card from an import, before we know which Card it is
+type importLine struct {
+	Line int
+	Query resolver.Query
+	// Skips resolving when set
+	CardID uuid.UUID
+	// Used to find the set when there's no set code
+	SetName string
+	Finish string
+	Condition string
+	Quantity int
+}
+
+// A line we couldn't turn into a collection entry
+type ImportProblem struct {
+	Line int `json:"line"`
+	Name string `json:"name"`
+	SetCode string `json:"set,omitempty"`
+	CollectorNumber string `json:"collector_number,omitempty"`
+	Status resolver.Status `json:"status,omitempty"`
+	Candidates []string `json:"candidates,omitempty"`
+	Message string `json:"message"`
+}
+
+// How an import changes one collection entry
+type ImportChange struct {
+	CardID uuid.UUID `json:"card_id"`
+	Name string `json:"name"`
+	SetCode string `json:"set"`
+	CollectorNumber string `json:"collector_number"`
+	Finish string `json:"finish"`
+	Condition string `json:"condition"`
+	// How many they have now
+	Current int `json:"current"`
+	// How many they'll have after the import
+	Quantity int `json:"quantity"`
+}
+
+type ImportResult struct {
+	Format string `json:"format,omitempty"`
+	Mode string `json:"mode"`
+	DryRun bool `json:"dry_run"`
+	Applied bool `json:"applied"`
+	// Identifies the import's changes in the collection history
+	BatchID *uuid.UUID `json:"batch_id,omitempty"`
+	// Everything's imported into this location, and replacing
+	// only replaces what's in it
+	LocationID uint `json:"location_id"`
+	Lines int `json:"lines"`
+	Changes []ImportChange `json:"changes"`
+	Problems []ImportProblem `json:"problems"`
+}
+
+type entryKey struct {
+	CardID uuid.UUID
+	Finish string
+	Condition string
+}
+
+// Turns importLines into cards, remembering what it's already
+// looked up since imports tend to repeat themselves
+type importResolver struct {
+	resolver *resolver.Resolver
+	cards map[uuid.UUID]*models.Card
+	queries map[resolver.Query]resolver.Result
+	setCodes map[string]string
+}
+
+func newImportResolver() *importResolver {
+	return &importResolver{
+		resolver: resolver.New(db),
+		cards: make(map[uuid.UUID]*models.Card),
+		queries: make(map[resolver.Query]resolver.Result),
+		setCodes: make(map[string]string),
+	}
+}
+
+func (r *importResolver) setCode(name string) (string, error) {
+	code, ok := r.setCodes[name]
+	if ok {
+		return code, nil
+	}
+
+	var codes []string
+	err := db.Model(&models.Set{}).
+	          Where("LOWER(name) = LOWER(?)", name).
+	          Limit(1).
+	          Pluck("code", &codes).
+	          Error
+	if err != nil {
+		return "", err
+	}
+	if len(codes) > 0 {
+		code = codes[0]
+	}
+
+	r.setCodes[name] = code
+	return code, nil
+}
+
+func (r *importResolver) card(id uuid.UUID) (*models.Card, error) {
+	card, ok := r.cards[id]
+	if ok {
+		return card, nil
+	}
+
+	var cards []models.Card
+	err := db.Scopes(fullCard).
+	          Where("cards.id = ?", id).
+	          Limit(1).
+	          Find(&cards).
+	          Error
+	if err != nil {
+		return nil, err
+	}
+	if len(cards) > 0 {
+		card = &cards[0]
+	}
+
+	r.cards[id] = card
+	return card, nil
+}
+
+// Finds the card line refers to. Returns a problem rather
+// than a card when there's no single card it could be.
+func (r *importResolver) resolve(line importLine) (*models.Card, *ImportProblem, error) {
+	problem := &ImportProblem{
+		Line: line.Line,
+		Name: line.Query.Name,
+		SetCode: line.Query.SetCode,
+		CollectorNumber: line.Query.CollectorNumber,
+	}
+
+	var card *models.Card
+	if line.CardID != uuid.Nil {
+		var err error
+		card, err = r.card(line.CardID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if card == nil {
+		query := line.Query
+		if query.SetCode == "" && line.SetName != "" {
+			code, err := r.setCode(line.SetName)
+			if err != nil {
+				return nil, nil, err
+			}
+			query.SetCode = code
+		}
+
+		result, ok := r.queries[query]
+		if !ok {
+			var err error
+			result, err = r.resolver.Resolve(query)
+			if err != nil {
+				return nil, nil, err
+			}
+			r.queries[query] = result
+		}
+
+		if result.Status != resolver.StatusResolved {
+			problem.Status = result.Status
+			problem.Candidates = result.Candidates
+			if result.Status == resolver.StatusAmbiguous {
+				problem.Message = "Could be more than one card"
+			} else {
+				problem.Message = "Couldn't find the card"
+			}
+			return nil, problem, nil
+		}
+		card = result.Card
+	}
+
+	if !card.Finishes.Has(line.Finish) {
+		problem.Message = fmt.Sprintf("%s (%s) isn't available in %s", card.Name, strings.ToUpper(card.Set.Code), line.Finish)
+		return nil, problem, nil
+	}
+
+	return card, nil, nil
+}
+
+// Works out how importing lines would change a user's collection,
+// along with the entries it should end up with. Nothing is saved.
+func planImport(userID uint, mode string, lines []importLine, result *ImportResult) ([]models.CollectionEntry, error) {
+	importResolver := newImportResolver()
+
+	var keys []entryKey
+	imported := make(map[entryKey]int)
+	cards := make(map[uuid.UUID]*models.Card)
+	for _, line := range lines {
+		card, problem, err := importResolver.resolve(line)
+		if err != nil {
+			return nil, err
+		}
+		if problem != nil {
+			result.Problems = append(result.Problems, *problem)
+			continue
+		}
+
+		key := entryKey{CardID: card.ID, Finish: line.Finish, Condition: line.Condition}
+		if _, ok := imported[key]; !ok {
+			keys = append(keys, key)
+		}
+		imported[key] += line.Quantity
+		cards[card.ID] = card
+	}
+
+	var existing []models.CollectionEntry
+	err := db.Model(&models.CollectionEntry{}).
+	          Where("user_id = ?", userID).
+	          Where("location_id = ?", result.LocationID).
+	          Where("quantity > 0").
+	          Find(&existing).
+	          Error
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[entryKey]int)
+	var removed []entryKey
+	var removedIDs []uuid.UUID
+	for _, entry := range existing {
+		key := entryKey{CardID: entry.CardID, Finish: entry.Finish, Condition: entry.Condition}
+		current[key] = entry.Quantity
+		if _, ok := imported[key]; !ok && mode == importModeReplace {
+			removed = append(removed, key)
+			removedIDs = append(removedIDs, key.CardID)
+		}
+	}
+
+	entries := []models.CollectionEntry{}
+	for _, key := range keys {
+		quantity := imported[key]
+		if mode == importModeAdd {
+			quantity += current[key]
+		}
+
+		card := cards[key.CardID]
+		result.Changes = append(result.Changes, ImportChange{
+			CardID: key.CardID,
+			Name: card.Name,
+			SetCode: card.Set.Code,
+			CollectorNumber: card.CollectorNumber,
+			Finish: key.Finish,
+			Condition: key.Condition,
+			Current: current[key],
+			Quantity: quantity,
+		})
+		entries = append(entries, models.CollectionEntry{
+			UserID: userID,
+			CardID: key.CardID,
+			Finish: key.Finish,
+			Condition: key.Condition,
+			LocationID: result.LocationID,
+			Quantity: imported[key],
+		})
+	}
+
+	// Replacing gets rid of everything that wasn't imported
+	if len(removed) > 0 {
+		removedCards, err := findCardsByID(removedIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range removed {
+			card := removedCards[key.CardID]
+			result.Changes = append(result.Changes, ImportChange{
+				CardID: key.CardID,
+				Name: card.Name,
+				SetCode: card.Set.Code,
+				CollectorNumber: card.CollectorNumber,
+				Finish: key.Finish,
+				Condition: key.Condition,
+				Current: current[key],
+				Quantity: 0,
+			})
+		}
+	}
+
+	return entries, nil
+}
+
+// Saves the entries from planImport in a single transaction
+// so a failed import doesn't leave a collection half imported.
+// The changes are recorded as one batch in the collection history.
+func applyImport(userID uint, result *ImportResult, entries []models.CollectionEntry) error {
+	batchID := uuid.New()
+	var changes []models.CollectionChange
+	for _, importChange := range result.Changes {
+		if importChange.Quantity == importChange.Current {
+			continue
+		}
+		changes = append(changes, models.CollectionChange{
+			UserID: userID,
+			ActorID: userID,
+			CardID: importChange.CardID,
+			Finish: importChange.Finish,
+			Condition: importChange.Condition,
+			LocationID: result.LocationID,
+			Delta: importChange.Quantity - importChange.Current,
+			Source: models.ChangeSourceImport,
+			BatchID: &batchID,
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if len(changes) > 0 {
+			err := tx.CreateInBatches(changes, 1000).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		quantity := gorm.Expr("collection_entries.quantity + excluded.quantity")
+		if result.Mode == importModeReplace {
+			// Only entries that weren't imported are deleted, the rest are
+			// updated in place so their tags and deck allocations stay put
+			var removed [][]interface{}
+			for _, importChange := range result.Changes {
+				if importChange.Quantity == 0 {
+					removed = append(removed, []interface{}{importChange.CardID, importChange.Finish, importChange.Condition})
+				}
+			}
+
+			if len(removed) > 0 {
+				// Soft deleted entries would still count towards
+				// the unique index, so these are gone for good
+				err := tx.Unscoped().
+				          Where("user_id = ?", userID).
+				          Where("location_id = ?", result.LocationID).
+				          Where("(card_id, finish, condition) IN ?", removed).
+				          Delete(&models.CollectionEntry{}).
+				          Error
+				if err != nil {
+					return err
+				}
+			}
+			quantity = gorm.Expr("excluded.quantity")
+		}
+
+		if len(entries) == 0 {
+			return nil
+		}
+
+		return tx.Clauses(clause.OnConflict{
+			Columns: entryColumns,
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"quantity": quantity,
+				"version": gorm.Expr("collection_entries.version + 1"),
+			}),
+		}).CreateInBatches(entries, 1000).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	result.BatchID = &batchID
+	return nil
+}
+
+// Plans an import and, unless it's a dry run or some lines
+// couldn't be resolved, applies it
+func runImport(c *gin.Context, result ImportResult, lines []importLine) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	locations, err := existingLocations(user.ID, []uint{result.LocationID})
+	if err != nil {
+		log.Printf("Got unexpected error finding location: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	if !locations[result.LocationID] {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrLocationNotFound.Error()})
+		return
+	}
+
+	result.Lines = len(lines)
+	entries, err := planImport(user.ID, result.Mode, lines, &result)
+	if err != nil {
+		log.Printf("Got unexpected error planning import: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	if result.DryRun {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+	// We'd rather they fix the problems than end up
+	// with a collection that's mysteriously short
+	if len(result.Problems) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	err = applyImport(user.ID, &result, entries)
+	if err != nil {
+		log.Printf("Got unexpected error applying import: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	result.Applied = true
+	c.JSON(http.StatusOK, result)
+}
+
+// Reads the options every kind of import shares
+func newImportResult(c *gin.Context) (ImportResult, error) {
+	result := ImportResult{
+		Mode: c.DefaultQuery("mode", importModeAdd),
+		DryRun: c.Query("dryRun") == "true",
+		Changes: []ImportChange{},
+		Problems: []ImportProblem{},
+	}
+	if result.Mode != importModeAdd && result.Mode != importModeReplace {
+		return result, ErrUnknownImportMode
+	}
+
+	location, err := locationQuery(c)
+	if err != nil {
+		return result, err
+	}
+	if location != nil {
+		result.LocationID = *location
+	}
+	return result, nil
+}
+
+// Imports a CSV file exported by another tool. The format is
+// detected from the header unless it's given.
+func importCollection(c *gin.Context) {
+	result, err := newImportResult(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	if c.Query("format") == textFormat {
+		importDecklist(c, result)
+		return
+	}
+
+	var format *collectioncsv.Format
+	if name := c.Query("format"); name != "" {
+		var ok bool
+		format, ok = collectioncsv.Lookup(name)
+		if !ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrUnknownFormat.Error()})
+			return
+		}
+	}
+
+	reader, err := collectioncsv.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize), format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidCSV.Error()})
+		return
+	}
+	result.Format = reader.Format.Name
+
+	var lines []importLine
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		var rowError *collectioncsv.RowError
+		var parseError *csv.ParseError
+		if errors.As(err, &rowError) {
+			result.Problems = append(result.Problems, ImportProblem{
+				Line: rowError.Line,
+				Message: rowError.Error(),
+			})
+			continue
+		} else if errors.As(err, &parseError) {
+			result.Problems = append(result.Problems, ImportProblem{
+				Line: parseError.Line,
+				Message: parseError.Error(),
+			})
+			continue
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidCSV.Error()})
+			return
+		}
+
+		line := importLine{
+			Line: row.Line,
+			Query: resolver.Query{
+				Name: row.Name,
+				SetCode: row.SetCode,
+				CollectorNumber: row.CollectorNumber,
+				Language: row.Language,
+			},
+			SetName: row.SetName,
+			Finish: row.Finish,
+			Condition: row.Condition,
+			Quantity: row.Quantity,
+		}
+		if row.ScryfallID != "" {
+			line.CardID = uuid.MustParse(row.ScryfallID)
+		}
+		lines = append(lines, line)
+	}
+
+	runImport(c, result, lines)
+}
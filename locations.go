@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+)
+
+type LocationRequest struct {
+	Name string `json:"name"`
+}
+
+// A location along with how many cards are in it
+type LocationSummary struct {
+	ID uint `json:"id"`
+	Name string `json:"name"`
+	Quantity int `json:"quantity"`
+}
+
+type MoveRequest struct {
+	UpdateRequest
+	// Where the copies go, LocationID is where they come from
+	ToLocationID uint `json:"to_location_id"`
+}
+
+type MoveResult struct {
+	// Reverting this batch puts the copies back
+	BatchID uuid.UUID `json:"batch_id"`
+	From models.CollectionEntry `json:"from"`
+	To models.CollectionEntry `json:"to"`
+	// Claims decks had on the copies that moved, they
+	// follow the copies to the entry they were moved to
+	Allocations []AffectedAllocation `json:"allocations"`
+}
+
+// Returns which of ids are the user's locations. 0 means
+// not in any location so it always exists.
+func existingLocations(userID uint, ids []uint) (map[uint]bool, error) {
+	exists := map[uint]bool{0: true}
+
+	var lookup []uint
+	for _, id := range ids {
+		if id != 0 {
+			lookup = append(lookup, id)
+		}
+	}
+	if len(lookup) == 0 {
+		return exists, nil
+	}
+
+	var found []uint
+	err := db.Model(&models.Location{}).
+	          Where("user_id = ?", userID).
+	          Where("id IN ?", lookup).
+	          Pluck("id", &found).
+	          Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range found {
+		exists[id] = true
+	}
+	return exists, nil
+}
+
+// Reads the location_id query parameter listings are filtered by,
+// nil when there isn't one
+func locationQuery(c *gin.Context) (*uint, error) {
+	value := c.Query("location_id")
+	if value == "" {
+		return nil, nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidLocationID
+	}
+	location := uint(id)
+	return &location, nil
+}
+
+// Narrows userCollection down to a location, if there is one
+func inLocation(location *uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if location == nil {
+			return db
+		}
+		return db.Where("collection_entries.location_id = ?", *location)
+	}
+}
+
+// Lists a user's locations and how many cards are in each
+func locationsEndpoint(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	locations := []LocationSummary{}
+	err = db.Model(&models.Location{}).
+	         Select("locations.id, locations.name, COALESCE(SUM(collection_entries.quantity), 0) AS quantity").
+	         Joins("LEFT JOIN collection_entries ON collection_entries.location_id = locations.id " +
+	               "AND collection_entries.user_id = locations.user_id").
+	         Where("locations.user_id = ?", user.ID).
+	         Group("locations.id, locations.name").
+	         Order("locations.name").
+	         Scan(&locations).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding locations: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, locations)
+}
+
+func createLocationEndpoint(c *gin.Context) {
+	var request LocationRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrMissingName.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	location := models.Location{UserID: user.ID, Name: request.Name}
+	err = db.Create(&location).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		c.JSON(http.StatusConflict, ErrorResponse{Message: ErrLocationExists.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error creating location: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, location)
+}
+
+// Deletes an empty location. We don't guess where the
+// cards in it have gone, they have to be moved out first.
+func deleteLocationEndpoint(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrLocationNotFound.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&models.CollectionEntry{}).
+		          Where("user_id = ?", user.ID).
+		          Where("location_id = ?", id).
+		          Count(&count).
+		          Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrLocationNotEmpty
+		}
+
+		// Deleted for good so the name can be used again
+		result := tx.Unscoped().
+		             Where("id = ?", id).
+		             Where("user_id = ?", user.ID).
+		             Delete(&models.Location{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLocationNotFound
+		}
+		return nil
+	})
+	if errors.Is(err, ErrLocationNotEmpty) {
+		c.JSON(http.StatusConflict, ErrorResponse{Message: ErrLocationNotEmpty.Error()})
+		return
+	} else if errors.Is(err, ErrLocationNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrLocationNotFound.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error deleting location: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Moves copies of a card from one location to another. Both halves
+// of the move share a batch so reverting it puts them back.
+// If-Match is checked against the entry the copies come from.
+// Tags describe the copies rather than where they're kept,
+// so the entry they're moved to gets the same tags. Claimed
+// copies are moved after free ones and their claims go with them.
+func moveInCollection(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	var request MoveRequest
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+	err = request.validate()
+	if err == nil && (request.Quantity <= 0 || request.LocationID == request.ToLocationID) {
+		err = ErrInvalidMove
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	locations, err := existingLocations(user.ID, []uint{request.LocationID, request.ToLocationID})
+	if err != nil {
+		log.Printf("Got unexpected error finding locations: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	if !locations[request.LocationID] || !locations[request.ToLocationID] {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrLocationNotFound.Error()})
+		return
+	}
+
+	result := MoveResult{
+		BatchID: uuid.New(),
+		From: request.entry(user.ID),
+		To: request.entry(user.ID),
+	}
+	result.From.Quantity = -request.Quantity
+	result.To.LocationID = request.ToLocationID
+	change := models.CollectionChange{ActorID: user.ID, Source: models.ChangeSourceMove, BatchID: &result.BatchID}
+	ifMatch := c.GetHeader("If-Match")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		current, err := lockEntry(tx, &result.From)
+		if err != nil {
+			return err
+		}
+		if !matchesETag(ifMatch, current) {
+			return ErrEntryChanged
+		}
+		if current.Quantity < request.Quantity {
+			return ErrNotEnoughToMove
+		}
+
+		// Taken first since the entry goes, tags and all, if they're all moved
+		tags, err := entryTagNames(tx, &result.From)
+		if err != nil {
+			return err
+		}
+		result.Allocations, err = excessClaims(tx, &result.From, current.Quantity - request.Quantity, true)
+		if err != nil {
+			return err
+		}
+		err = releaseClaims(tx, result.Allocations)
+		if err != nil {
+			return err
+		}
+
+		err = addToCollection(tx, &result.From, change)
+		if err != nil {
+			return err
+		}
+		err = addToCollection(tx, &result.To, change)
+		if err != nil {
+			return err
+		}
+		err = addEntryTags(tx, &result.To, tags)
+		if err != nil {
+			return err
+		}
+		return moveClaims(tx, result.Allocations, &result.To)
+	})
+	if errors.Is(err, ErrNotEnoughToMove) {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Message: ErrNotEnoughToMove.Error()})
+		return
+	} else if errors.Is(err, ErrEntryChanged) {
+		c.JSON(http.StatusPreconditionFailed, ErrorResponse{Message: ErrEntryChanged.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error moving cards: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
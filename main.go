@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -23,6 +24,28 @@ import (
 
 const (
 	pageSize = 30
+	topValueSize = 10
+	maxTopValueSize = 100
+	moversDays = 7
+	maxMoversDays = 365
+	priceHistoryDays = 90
+	autocompleteSize = 10
+	maxAutocompleteSize = 25
+	maxBatchSize = 1000
+
+	// The collector_number sorting is a bit wild
+	// We check if it's a number and then cast it to a number
+	// if not, then we try to find a substring that's an number
+	// and cast that to a number and add a large number to
+	// preserve the order of non-numeric collector_numbers while still
+	// making it larger than any numeric one.
+	// lastly, if there are no numbers in the collector_number we just make it a large number
+	collectorNumberOrder = `
+		CASE
+		  WHEN collector_number ~ '^[0-9]+$' THEN cast(collector_number as int)
+		  WHEN collector_number ~ '[0-9]+' THEN cast(substring(collector_number from '[0-9]+') as int) + 100000000
+		  ELSE 100000000
+		END`
 )
 
 var (
@@ -39,6 +62,54 @@ var (
 	ErrInvalidToken error = errors.New("Invalid JWT token")
 	ErrMissingKID error = errors.New("Token missing kid header. Provided JWT likely wasn't generated by this server")
 	ErrInvalidUUID error = errors.New("Invalid UUID")
+	ErrSetNotFound error = errors.New("Set not found")
+	ErrCardNotFound error = errors.New("Card not found")
+	ErrMissingName error = errors.New("Missing name")
+	ErrUserNotFound error = errors.New("User not found")
+	ErrUnknownFinish error = errors.New("Unknown finish, expected nonfoil, foil or etched")
+	ErrUnknownCondition error = errors.New("Unknown condition, expected near_mint, lightly_played, moderately_played, heavily_played or damaged")
+	ErrUnknownFormat error = errors.New("Unknown format, expected moxfield, deckbox, manabox, tcgplayer or text")
+	ErrUnknownImportMode error = errors.New("Unknown mode, expected add or replace")
+	ErrEntryNotFound error = errors.New("Collection entry not found")
+	ErrEntryChanged error = errors.New("Collection entry has changed since you last saw it")
+	ErrInvalidLocationID error = errors.New("Invalid location_id")
+	ErrLocationNotFound error = errors.New("Location not found")
+	ErrLocationExists error = errors.New("There's already a location with that name")
+	ErrLocationNotEmpty error = errors.New("Move the cards out of the location before deleting it")
+	ErrInvalidMove error = errors.New("Moves need a positive quantity and two different locations")
+	ErrNotEnoughToMove error = errors.New("There aren't that many copies to move")
+	ErrInvalidTag error = errors.New("Tags can't be empty or longer than 50 characters")
+	ErrMissingTags error = errors.New("Give at least one entry and one tag")
+	ErrInvalidWishlistCard error = errors.New("Wishlist items need exactly one of card_id or oracle_id")
+	ErrInvalidWishlistItem error = errors.New("Wishlist items need a positive quantity and max_price")
+	ErrWishlistItemNotFound error = errors.New("Wishlist item not found")
+	ErrNotTrading error = errors.New("That user isn't open to trades")
+	ErrProposalNotFound error = errors.New("Trade proposal not found")
+	ErrInvalidProposal error = errors.New("Proposals need another user and at least one card with a positive quantity")
+	ErrNotEnoughToTrade error = errors.New("There aren't enough copies for that trade")
+	ErrDeckNotFound error = errors.New("Deck not found")
+	ErrDeckExists error = errors.New("There's already a deck with that name")
+	ErrInvalidDeckCard error = errors.New("Deck cards need exactly one of card_id or oracle_id and a positive quantity")
+	ErrUnknownZone error = errors.New("Unknown zone, expected main, side, maybe or commander")
+	ErrCardNotInDeck error = errors.New("That card isn't in the deck")
+	ErrUnknownDeckFormat error = errors.New("Unknown format, expected standard, pioneer, modern, legacy, vintage, pauper, penny, historic, explorer, timeless, alchemy, premodern, commander, duel, paupercommander, brawl or standardbrawl")
+	ErrMissingDeckFormat error = errors.New("Give a format to check the deck against")
+	ErrTooManyDeckCards error = errors.New("Decks can't have more than 250 different cards")
+	ErrUnknownProposalState error = errors.New("Unknown state, expected pending, accepted, declined, countered or cancelled")
+	ErrChangeNotFound error = errors.New("No changes to revert")
+	ErrInvalidRevert error = errors.New("Revert needs exactly one of change_id or batch_id")
+	ErrTradeRevert error = errors.New("Trades can't be reverted")
+	ErrTooManyUpdates error = errors.New("Too many updates in one batch")
+	ErrNegativeQuantity error = errors.New("Can't set a negative quantity")
+	ErrQuantityAndSet error = errors.New("Give either quantity or set, not both")
+	ErrInvalidDecklist error = errors.New("Couldn't read decklist")
+	ErrInvalidCSV error = errors.New("Couldn't read CSV, it should start with the header row of a Moxfield, Deckbox, ManaBox or TCGplayer export")
+	ErrUnknownCurrency error = errors.New("Unknown currency, expected usd, eur or tix")
+	ErrUnknownDirection error = errors.New("Unknown direction, expected above or below")
+	ErrInvalidAlertCard error = errors.New("Alerts need exactly one of card_id or oracle_id")
+	ErrInvalidAlertPrice error = errors.New("Alerts need exactly one positive threshold or percent_change")
+	ErrAlertNotFound error = errors.New("Alert not found")
+	ErrUnknownMatchType error = errors.New("Unknown match type, expected exact, insensitive or fuzzy")
 	// TODO: The string "my_secret_key" is just an example and should be replaced with a secret key of sufficient length and complexity in a real-world scenario.
 	jwtKey = []byte("my_secret_key")
 
@@ -96,10 +167,55 @@ func setupRouter() *gin.Engine {
 	{
 		tokenAuthorized.POST("/:user/collection/:action", collectionPostEndpoint)
 		tokenAuthorized.GET("/:user/collection/cards/:id", collectionGetCardsByID)
+		tokenAuthorized.GET("/:user/collection/oracle/:id", collectionGetOracleCard)
+		tokenAuthorized.GET("/:user/collection/summary", collectionSummaryEndpoint)
+		tokenAuthorized.GET("/:user/collection/value", collectionValueEndpoint)
+		tokenAuthorized.GET("/:user/collection/movers", collectionMoversEndpoint)
+		tokenAuthorized.GET("/:user/collection/export", collectionExportEndpoint)
+		tokenAuthorized.GET("/:user/collection/history", collectionHistoryEndpoint)
+		tokenAuthorized.GET("/:user/collection/free", collectionFreeEndpoint)
+		tokenAuthorized.GET("/:user/tags", tagsEndpoint)
+		tokenAuthorized.GET("/:user/locations", locationsEndpoint)
+		tokenAuthorized.POST("/:user/locations", createLocationEndpoint)
+		tokenAuthorized.DELETE("/:user/locations/:id", deleteLocationEndpoint)
+		tokenAuthorized.GET("/:user/wishlist", wishlistEndpoint)
+		tokenAuthorized.GET("/:user/wishlist/satisfied", wishlistSatisfiedEndpoint)
+		tokenAuthorized.POST("/:user/wishlist", createWishlistItemEndpoint)
+		tokenAuthorized.DELETE("/:user/wishlist/:id", deleteWishlistItemEndpoint)
+		tokenAuthorized.GET("/:user/trade/settings", tradeSettingsEndpoint)
+		tokenAuthorized.PUT("/:user/trade/settings", updateTradeSettingsEndpoint)
+		tokenAuthorized.GET("/:user/trade/matches", tradeMatchesEndpoint)
+		tokenAuthorized.GET("/:user/trade/proposals", tradeProposalsEndpoint)
+		tokenAuthorized.POST("/:user/trade/proposals", createTradeProposalEndpoint)
+		tokenAuthorized.GET("/:user/trade/proposals/:id", tradeProposalEndpoint)
+		tokenAuthorized.POST("/:user/trade/proposals/:id/:action", tradeProposalActionEndpoint)
+		tokenAuthorized.GET("/:user/decks", decksEndpoint)
+		tokenAuthorized.POST("/:user/decks", createDeckEndpoint)
+		tokenAuthorized.GET("/:user/decks/:id", deckEndpoint)
+		tokenAuthorized.PUT("/:user/decks/:id", updateDeckEndpoint)
+		tokenAuthorized.DELETE("/:user/decks/:id", deleteDeckEndpoint)
+		tokenAuthorized.GET("/:user/decks/:id/ownership", deckOwnershipEndpoint)
+		tokenAuthorized.GET("/:user/decks/:id/legality", deckLegalityEndpoint)
+		tokenAuthorized.GET("/:user/decks/:id/allocations", deckAllocationsEndpoint)
+		tokenAuthorized.POST("/:user/decks/:id/allocations", allocateToDeckEndpoint)
+		tokenAuthorized.GET("/:user/allocations", allocationReportEndpoint)
+		tokenAuthorized.GET("/:user/alerts", alertsEndpoint)
+		tokenAuthorized.POST("/:user/alerts", createAlertEndpoint)
+		tokenAuthorized.DELETE("/:user/alerts/:id", deleteAlertEndpoint)
+		tokenAuthorized.GET("/:user/notifications", notificationsEndpoint)
+		tokenAuthorized.POST("/:user/notifications/read", readNotificationsEndpoint)
 		tokenAuthorized.GET("/:user", userEndpoint)
 	}
 
 	r.GET("/api/cards/search", searchEndpoint)
+	r.GET("/api/cards/autocomplete", autocompleteEndpoint)
+	r.GET("/api/cards/named", namedEndpoint)
+	r.GET("/api/cards/:id", cardEndpoint)
+	r.GET("/api/cards/:id/prices", cardPricesEndpoint)
+	r.GET("/api/cards/:id/:number", cardBySetNumberEndpoint)
+	r.GET("/api/cards/:id/:number/:lang", cardBySetNumberEndpoint)
+	r.GET("/api/sets", setsEndpoint)
+	r.GET("/api/sets/:code", setEndpoint)
 
 	r.POST("/api/register", registerEndpoint)
 	r.POST("/api/login", loginEndpoint)
@@ -245,6 +361,21 @@ func searchScope(nameContains string, defaultOnly, includeDigitalExclusive bool)
 	}
 }
 
+// Orders printings of the same card so the one we'd
+// most like to show someone comes first
+func printingOrder(db *gorm.DB) *gorm.DB {
+	// Of course the collector_number ordering happens after
+	// the other orderings so it's rarely relevant here
+	return db.Order(`
+	          CASE
+	            WHEN language = 'en' THEN 0
+	            ELSE 1
+	          END`).
+	          Order("release_date desc").
+	          Order("default_lang desc").
+	          Order(collectorNumberOrder)
+}
+
 func searchEndpoint(c *gin.Context) {
 		// nameContains is never empty because of the %%
 		// so even without a parameter we will search for everything
@@ -252,6 +383,11 @@ func searchEndpoint(c *gin.Context) {
 		defaultOnly := c.Query("defaultOnly") == "true"
 		collapsePrintings := c.Query("collapsePrintings") == "true"
 		includeDigitalExclusive := c.Query("includeDigitalExclusive") == "true"
+		filters, err := parseCardFilters(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+			return
+		}
 
 		// collapsePrintings implies defaultOnly
 		if collapsePrintings {
@@ -261,12 +397,13 @@ func searchEndpoint(c *gin.Context) {
 		// Get count for query
 		var count int64
 		result := db.Model(&models.Card{}).
-		            Scopes(searchScope(nameContains, defaultOnly, includeDigitalExclusive))
+		            Scopes(searchScope(nameContains, defaultOnly, includeDigitalExclusive)).
+		            Scopes(cardFiltersScope(filters))
 
 		if collapsePrintings {
-			result = result.Distinct("name")
+			result = result.Distinct("oracle_id")
 		}
-		err := result.Count(&count).
+		err = result.Count(&count).
 		              Error
 		if err != nil {
 			log.Fatal(err)
@@ -274,39 +411,29 @@ func searchEndpoint(c *gin.Context) {
 
 		// Get rows for query
 		var cards []models.Card
-		result = db.Model(&models.Card{}).
-		            Preload("Set").
-		            Preload("Finishes").
-		            Preload("Faces").
-		            Scopes(searchScope(nameContains, defaultOnly, includeDigitalExclusive))
-
 		if collapsePrintings {
-			// This is a postgres exclusive trick
-			result = result.Select("DISTINCT ON (name) *")
+			// This is a postgres exclusive trick, DISTINCT ON keeps the first
+			// row for each oracle card. It needs oracle_id to come first in the
+			// ORDER BY, so we pick the printings in a subquery and order them after.
+			printings := db.Model(&models.Card{}).
+			                Scopes(searchScope(nameContains, defaultOnly, includeDigitalExclusive)).
+			                Scopes(cardFiltersScope(filters)).
+			                Select("DISTINCT ON (oracle_id) *").
+			                Order("oracle_id").
+			                Scopes(printingOrder)
+			result = db.Table("(?) AS cards", printings)
+		} else {
+			result = db.Model(&models.Card{}).
+			            Scopes(searchScope(nameContains, defaultOnly, includeDigitalExclusive)).
+			            Scopes(cardFiltersScope(filters))
 		}
 
-		// The collector_number sorting is a bit wild
-		// We check if it's a number and then cast it to a number
-		// if not, then we try to find a substring that's an number
-		// and cast that to a number and add a large number to
-		// preserve the order of non-numeric collector_numbers while still
-		// making it larger than any numeric one.
-		// lastly, if there are no numbers in the collector_number we just make it a large number
-		// Of course this happens after the other searches so it's rarely relevant
-		result = result.Order("name").
-		                Order(`
-		                CASE
-		                  WHEN language = 'en' THEN 0
-		                  ELSE 1
-		                END`).
-		                Order("release_date desc").
-		                Order("default_lang desc").
-		                Order(`
-		                CASE
-		                  WHEN collector_number ~ '^[0-9]+$' THEN cast(collector_number as int)
-		                  WHEN collector_number ~ '[0-9]+' THEN cast(substring(collector_number from '[0-9]+') as int) + 100000000
-		                  ELSE 100000000
-		                END`).
+		result = result.Preload("Set").
+		                Preload("Finishes").
+		                Preload("Faces").
+		                Preload("Legalities").
+		                Order("name").
+		                Scopes(printingOrder).
 		                Scopes(Paginate(c)).
 		                Find(&cards)
 
@@ -328,42 +455,344 @@ func searchEndpoint(c *gin.Context) {
 
 type UpdateRequest struct {
 	CardID uuid.UUID `json:"card_id"`
+	// Defaults to nonfoil
+	Finish string `json:"finish"`
+	// Defaults to near_mint
+	Condition string `json:"condition"`
+	// Defaults to 0, not in any location
+	LocationID uint `json:"location_id"`
 	Quantity int `json:"quantity"`
 }
 
-func updateCollection(c *gin.Context) {
-	var dbUser models.User
-	db.Model(&models.User{}).Select("id").Where("username = ?", c.Param("user")).First(&dbUser)
+// Fills in the defaults and checks the finish and condition are real
+func (updateRequest *UpdateRequest) validate() error {
+	if updateRequest.Finish == "" {
+		updateRequest.Finish = models.FinishNonfoil
+	} else if !models.IsFinish(updateRequest.Finish) {
+		return ErrUnknownFinish
+	}
+	if updateRequest.Condition == "" {
+		updateRequest.Condition = models.ConditionNearMint
+	} else if !models.IsCondition(updateRequest.Condition) {
+		return ErrUnknownCondition
+	}
+	return nil
+}
 
-	var updateRequest UpdateRequest
-	c.BindJSON(&updateRequest)
-	collectionEntry := models.CollectionEntry {
-		UserID: dbUser.ID,
+func (updateRequest UpdateRequest) entry(userID uint) models.CollectionEntry {
+	return models.CollectionEntry {
+		UserID: userID,
 		CardID: updateRequest.CardID,
+		Finish: updateRequest.Finish,
+		Condition: updateRequest.Condition,
+		LocationID: updateRequest.LocationID,
 		Quantity: updateRequest.Quantity,
 	}
+}
+
+// The columns that make a collection entry unique
+var entryColumns = []clause.Column{{Name: "user_id"}, {Name: "card_id"}, {Name: "finish"}, {Name: "condition"}, {Name: "location_id"}}
+
+// Finds the stored version of collectionEntry
+func sameEntry(collectionEntry *models.CollectionEntry) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("user_id = ?", collectionEntry.UserID).
+		          Where("card_id = ?", collectionEntry.CardID).
+		          Where("finish = ?", collectionEntry.Finish).
+		          Where("condition = ?", collectionEntry.Condition).
+		          Where("location_id = ?", collectionEntry.LocationID)
+	}
+}
+
+// Entries that reach zero are deleted rather than left lying around.
+// They're deleted for good since soft deleted entries would still be
+// in the way of the unique index.
+func removeIfEmpty(tx *gorm.DB, collectionEntry *models.CollectionEntry) error {
+	if collectionEntry.Quantity > 0 {
+		return nil
+	}
+	return tx.Unscoped().Delete(&models.CollectionEntry{}, collectionEntry.ID).Error
+}
+
+// The quantity and version of an entry as it is now.
+// If there isn't an entry they're both 0.
+func findEntry(tx *gorm.DB, collectionEntry *models.CollectionEntry) (models.CollectionEntry, error) {
+	var current models.CollectionEntry
+	err := tx.Model(&models.CollectionEntry{}).
+	          Select("quantity", "version").
+	          Scopes(sameEntry(collectionEntry)).
+	          Limit(1).
+	          Find(&current).
+	          Error
+	return current, err
+}
+
+// Like findEntry, but locks the entry so nothing
+// else changes it until we're done
+func lockEntry(tx *gorm.DB, collectionEntry *models.CollectionEntry) (models.CollectionEntry, error) {
+	return findEntry(tx.Clauses(clause.Locking{Strength: "UPDATE"}), collectionEntry)
+}
+
+func entryETag(collectionEntry models.CollectionEntry) string {
+	return fmt.Sprintf(`"%d"`, collectionEntry.Version)
+}
+
+// Whether an If-Match header lets a request change current.
+// Entries that don't exist yet have no ETag, so nothing but
+// a missing header matches them.
+func matchesETag(ifMatch string, current models.CollectionEntry) bool {
+	if ifMatch == "" {
+		return true
+	}
+	if current.Version == 0 {
+		return false
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == entryETag(current) {
+			return true
+		}
+	}
+	return false
+}
+
+// Locks the entry and makes sure it's still the version the client
+// last saw, so two clients don't overwrite each other's changes
+func checkETag(tx *gorm.DB, collectionEntry *models.CollectionEntry, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	current, err := lockEntry(tx, collectionEntry)
+	if err != nil {
+		return err
+	}
+	if !matchesETag(ifMatch, current) {
+		return ErrEntryChanged
+	}
+	return nil
+}
+
+// Fills in change from an entry that used to have previous copies
+// and adds it to the ledger. Nothing is recorded if nothing changed.
+func recordChange(tx *gorm.DB, change models.CollectionChange, collectionEntry *models.CollectionEntry, previous int) error {
+	// A new entry can be inserted with a negative quantity
+	// before removeIfEmpty gets to it, but that's still none
+	change.Delta = max(collectionEntry.Quantity, 0) - previous
+	if change.Delta == 0 {
+		return nil
+	}
+
+	change.UserID = collectionEntry.UserID
+	change.CardID = collectionEntry.CardID
+	change.Finish = collectionEntry.Finish
+	change.Condition = collectionEntry.Condition
+	change.LocationID = collectionEntry.LocationID
+	return tx.Create(&change).Error
+}
+
+// Upserts collectionEntry with quantity as the update on conflict,
+// bumping its version, then records the change and tidies up if it's now empty
+func saveEntry(tx *gorm.DB, collectionEntry *models.CollectionEntry, quantity clause.Expr, change models.CollectionChange) error {
+	previous, err := lockEntry(tx, collectionEntry)
+	if err != nil {
+		return err
+	}
 
-	// This is kind of complicated so here's the explanation
-	// We create the collectionEntry, but on a conflict we
-	// add the quantity of the existing column to the quantity
-	// we were given. This gets wrapped in GREATEST(x, 0)
-	// so it doesn't go below 0 clause.Returning{} ensures that we
-	// put the value after resolving the conflict into &collectionEntry
-	result := db.Clauses(
+	err = tx.Clauses(
 		clause.OnConflict{
-			Columns: []clause.Column{{Name: "user_id"}, {Name: "card_id"}},
+			Columns: entryColumns,
 			DoUpdates: clause.Assignments(map[string]interface{}{
-				"quantity": gorm.Expr("GREATEST(collection_entries.quantity + ?, 0)", collectionEntry.Quantity)})},
+				"quantity": quantity,
+				"version": gorm.Expr("collection_entries.version + 1")})},
 		clause.Returning{},
-	).Create(&collectionEntry)
-	if result.Error != nil {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{Message: "Error creating db entry"})
+	).Create(collectionEntry).Error
+	if err != nil {
+		return err
+	}
+
+	err = recordChange(tx, change, collectionEntry, previous.Quantity)
+	if err != nil {
+		return err
+	}
+	return removeIfEmpty(tx, collectionEntry)
+}
+
+// This is kind of complicated so here's the explanation
+// We create the collectionEntry, but on a conflict we
+// add the quantity of the existing column to the quantity
+// we were given. This gets wrapped in GREATEST(x, 0)
+// so it doesn't go below 0 clause.Returning{} ensures that we
+// put the value after resolving the conflict into collectionEntry
+func addToCollection(tx *gorm.DB, collectionEntry *models.CollectionEntry, change models.CollectionChange) error {
+	return saveEntry(tx, collectionEntry, gorm.Expr("GREATEST(collection_entries.quantity + ?, 0)", collectionEntry.Quantity), change)
+}
+
+// Like addToCollection but replaces the quantity rather than adding to it
+func setInCollection(tx *gorm.DB, collectionEntry *models.CollectionEntry, change models.CollectionChange) error {
+	return saveEntry(tx, collectionEntry, gorm.Expr("excluded.quantity"), change)
+}
+
+// Returns which of ids are actual cards
+func existingCards(ids []uuid.UUID) (map[uuid.UUID]bool, error) {
+	var found []uuid.UUID
+	err := db.Model(&models.Card{}).
+	          Where("id IN ?", ids).
+	          Pluck("id", &found).
+	          Error
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[uuid.UUID]bool)
+	for _, id := range found {
+		exists[id] = true
+	}
+	return exists, nil
+}
+
+// Adds to a collection entry, or with set, replaces its quantity
+func writeCollectionUpdate(c *gin.Context, set bool) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	var updateRequest UpdateRequest
+	err = c.ShouldBindJSON(&updateRequest)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+	err = updateRequest.validate()
+	if err == nil && set && updateRequest.Quantity < 0 {
+		err = ErrNegativeQuantity
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	// Without this we'd happily make entries for cards that don't exist
+	exists, err := existingCards([]uuid.UUID{updateRequest.CardID})
+	if err != nil {
+		log.Printf("Got unexpected error finding card: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	if !exists[updateRequest.CardID] {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrCardNotFound.Error()})
 		return
 	}
 
+	locations, err := existingLocations(user.ID, []uint{updateRequest.LocationID})
+	if err != nil {
+		log.Printf("Got unexpected error finding location: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	if !locations[updateRequest.LocationID] {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrLocationNotFound.Error()})
+		return
+	}
+
+	collectionEntry := updateRequest.entry(user.ID)
+	change := models.CollectionChange{ActorID: user.ID, Source: models.ChangeSourceManual}
+	ifMatch := c.GetHeader("If-Match")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := checkETag(tx, &collectionEntry, ifMatch)
+		if err != nil {
+			return err
+		}
+		if set {
+			return setInCollection(tx, &collectionEntry, change)
+		}
+		return addToCollection(tx, &collectionEntry, change)
+	})
+	if errors.Is(err, ErrEntryChanged) {
+		c.JSON(http.StatusPreconditionFailed, ErrorResponse{Message: ErrEntryChanged.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error updating collection: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	if collectionEntry.Quantity > 0 {
+		c.Header("ETag", entryETag(collectionEntry))
+	}
 	c.JSON(http.StatusOK, collectionEntry)
 }
 
+func updateCollection(c *gin.Context) {
+	writeCollectionUpdate(c, false)
+}
+
+func setCollection(c *gin.Context) {
+	writeCollectionUpdate(c, true)
+}
+
+// Removes an entry entirely, the quantity in the request is ignored
+func removeFromCollection(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	var updateRequest UpdateRequest
+	err = c.ShouldBindJSON(&updateRequest)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+	err = updateRequest.validate()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	// The removed entry is returned so we know how many copies to record as removed
+	collectionEntry := updateRequest.entry(user.ID)
+	change := models.CollectionChange{ActorID: user.ID, Source: models.ChangeSourceManual}
+	ifMatch := c.GetHeader("If-Match")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := checkETag(tx, &collectionEntry, ifMatch)
+		if err != nil {
+			return err
+		}
+
+		var removed []models.CollectionEntry
+		err = tx.Unscoped().
+		          Clauses(clause.Returning{}).
+		          Scopes(sameEntry(&collectionEntry)).
+		          Delete(&removed).
+		          Error
+		if err != nil {
+			return err
+		}
+		if len(removed) == 0 {
+			return ErrEntryNotFound
+		}
+
+		collectionEntry.Quantity = 0
+		return recordChange(tx, change, &collectionEntry, removed[0].Quantity)
+	})
+	if errors.Is(err, ErrEntryNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrEntryNotFound.Error()})
+		return
+	} else if errors.Is(err, ErrEntryChanged) {
+		c.JSON(http.StatusPreconditionFailed, ErrorResponse{Message: ErrEntryChanged.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error removing from collection: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
 func collectionGetCardsByID(c *gin.Context) {
 	id := c.Param("id")
 	username := c.Param("user")
@@ -391,6 +820,22 @@ func collectionPostEndpoint(c *gin.Context) {
 	action := c.Param("action")
 	if action == "update" {
 		updateCollection(c)
+	} else if action == "import" {
+		importCollection(c)
+	} else if action == "set" {
+		setCollection(c)
+	} else if action == "remove" {
+		removeFromCollection(c)
+	} else if action == "batch" {
+		batchUpdateCollection(c)
+	} else if action == "revert" {
+		revertCollectionChanges(c)
+	} else if action == "move" {
+		moveInCollection(c)
+	} else if action == "tag" {
+		tagCollection(c)
+	} else if action == "untag" {
+		untagCollection(c)
 	} else {
 		errorMessage := fmt.Sprintf("Unknown action: %s", action)
 		c.JSON(http.StatusBadRequest, ErrorResponse{Message: errorMessage})
@@ -457,11 +902,55 @@ func main() {
 	}
 
 	err = db.AutoMigrate(&models.Card{},
+	                      &models.OracleCard{},
 	                      &models.Set{},
 	                      &models.Face{},
 	                      &models.Finish{},
+	                      &models.Legality{},
+	                      &models.PriceSnapshot{},
+	                      &models.AlertRule{},
+	                      &models.Notification{},
+	                      &models.WishlistItem{},
+	                      &models.TradeSettings{},
 	                      &models.User{},
-	                      &models.CollectionEntry{})
+	                      &models.Location{},
+	                      &models.CollectionEntry{},
+	                      &models.CollectionChange{},
+	                      &models.EntryTag{},
+	                      &models.TradeProposal{},
+	                      &models.TradeItem{},
+	                      &models.Deck{},
+	                      &models.DeckCard{},
+	                      &models.DeckAllocation{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Collection entries used to be unique per card, then per card and
+	// finish, then per card, finish and condition, now they're unique
+	// per card, finish, condition and location
+	for _, index := range []string{"idx_user_card", "idx_user_card_finish", "idx_collection_entry"} {
+		if db.Migrator().HasIndex(&models.CollectionEntry{}, index) {
+			err = db.Migrator().DropIndex(&models.CollectionEntry{}, index)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// Entries used to be left behind when their quantity reached zero
+	err = db.Unscoped().Where("quantity <= 0").Delete(&models.CollectionEntry{}).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Autocomplete relies on a trigram index, which gorm
+	// has no way to describe, so we create it ourselves
+	err = db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Exec("CREATE INDEX IF NOT EXISTS idx_cards_search_name_trgm ON cards USING gin (search_name gin_trgm_ops)").Error
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,193 @@
+package alerts
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Triggered says whether rule should fire when a price moves from
+// previous to current. previous is nil when there's no earlier price.
+// Threshold rules only fire when the price crosses the threshold,
+// so a card that stays above it doesn't notify every import.
+func Triggered(rule models.AlertRule, previous *float64, current float64) bool {
+	if rule.Threshold != nil {
+		threshold := *rule.Threshold
+		if rule.Direction == models.DirectionAbove {
+			return current >= threshold && (previous == nil || *previous < threshold)
+		}
+		return current <= threshold && (previous == nil || *previous > threshold)
+	}
+
+	if rule.PercentChange != nil {
+		if previous == nil || *previous == 0 {
+			return false
+		}
+
+		change := 100 * (current - *previous) / *previous
+		if rule.Direction == models.DirectionAbove {
+			return change >= *rule.PercentChange
+		}
+		return change <= -*rule.PercentChange
+	}
+
+	return false
+}
+
+func message(name string, rule models.AlertRule, previous *float64, current float64) string {
+	var what string
+	if rule.Threshold != nil {
+		verb := "rose above"
+		if rule.Direction == models.DirectionBelow {
+			verb = "fell below"
+		}
+		what = fmt.Sprintf("%s %.2f", verb, *rule.Threshold)
+	} else {
+		verb := "rose"
+		if rule.Direction == models.DirectionBelow {
+			verb = "fell"
+		}
+		what = fmt.Sprintf("%s %.1f%% from %.2f", verb, math.Abs(100 * (current - *previous) / *previous), *previous)
+	}
+
+	return fmt.Sprintf("%s (%s) %s %s, it's now %.2f %s", name, rule.Finish, what, rule.Currency, current, rule.Currency)
+}
+
+// The price for rule on date and the most recent price from before it.
+// Oracle rules use whichever printing is cheapest.
+// Returns a nil current price when there isn't one for date.
+func prices(db *gorm.DB, rule models.AlertRule, date time.Time) (current *float64, previous *float64, cardID uuid.UUID, err error) {
+	column := "price_snapshots." + models.PriceColumn(rule.Currency, rule.Finish)
+
+	type price struct {
+		CardID uuid.UUID
+		Price *float64
+	}
+
+	// The newest snapshot of each printing before date, or just the one printing
+	latestBefore := db.Model(&models.PriceSnapshot{}).
+	                   Select("DISTINCT ON (price_snapshots.card_id) price_snapshots.card_id, " + column + " AS price").
+	                   Where("price_snapshots.date < ?", date).
+	                   Where(column + " IS NOT NULL").
+	                   Order("price_snapshots.card_id").
+	                   Order("price_snapshots.date desc")
+	onDate := db.Model(&models.PriceSnapshot{}).
+	             Select("price_snapshots.card_id, " + column + " AS price").
+	             Where("price_snapshots.date = ?", date).
+	             Where(column + " IS NOT NULL")
+
+	if rule.CardID != nil {
+		latestBefore = latestBefore.Where("price_snapshots.card_id = ?", *rule.CardID)
+		onDate = onDate.Where("price_snapshots.card_id = ?", *rule.CardID)
+	} else {
+		latestBefore = latestBefore.Joins("JOIN cards ON cards.id = price_snapshots.card_id").
+		                            Where("cards.oracle_id = ?", *rule.OracleID)
+		onDate = onDate.Joins("JOIN cards ON cards.id = price_snapshots.card_id").
+		                Where("cards.oracle_id = ?", *rule.OracleID)
+	}
+
+	var cheapest []price
+	err = db.Table("(?) AS prices", onDate).
+	         Order("price").
+	         Limit(1).
+	         Scan(&cheapest).
+	         Error
+	if err != nil || len(cheapest) == 0 {
+		return nil, nil, uuid.Nil, err
+	}
+
+	var cheapestBefore []price
+	err = db.Table("(?) AS prices", latestBefore).
+	         Order("price").
+	         Limit(1).
+	         Scan(&cheapestBefore).
+	         Error
+	if err != nil {
+		return nil, nil, uuid.Nil, err
+	}
+	if len(cheapestBefore) > 0 {
+		previous = cheapestBefore[0].Price
+	}
+
+	return cheapest[0].Price, previous, cheapest[0].CardID, nil
+}
+
+// Evaluate checks every alert rule against the price snapshots
+// taken on date and creates a Notification for each one that fires.
+// It's meant to be run by the importer once prices are refreshed.
+// Rules that already fired on date are skipped, so running it
+// again the same day doesn't notify anyone twice.
+func Evaluate(db *gorm.DB, date time.Time) (int, error) {
+	var rules []models.AlertRule
+	err := db.Model(&models.AlertRule{}).Find(&rules).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var firedIDs []uint
+	err = db.Unscoped().
+	         Model(&models.Notification{}).
+	         Where("date = ?", date).
+	         Pluck("alert_rule_id", &firedIDs).
+	         Error
+	if err != nil {
+		return 0, err
+	}
+	fired := make(map[uint]bool)
+	for _, id := range firedIDs {
+		fired[id] = true
+	}
+
+	var notifications []models.Notification
+	for _, rule := range rules {
+		if fired[rule.ID] {
+			continue
+		}
+
+		current, previous, cardID, err := prices(db, rule, date)
+		if err != nil {
+			return 0, err
+		}
+		if current == nil || !Triggered(rule, previous, *current) {
+			continue
+		}
+
+		var name string
+		err = db.Model(&models.Card{}).
+		         Select("name").
+		         Where("id = ?", cardID).
+		         Scan(&name).
+		         Error
+		if err != nil {
+			return 0, err
+		}
+
+		notifications = append(notifications, models.Notification{
+			UserID: rule.UserID,
+			AlertRuleID: rule.ID,
+			Date: date,
+			CardID: cardID,
+			Message: message(name, rule, previous, *current),
+			Price: *current,
+			PreviousPrice: previous,
+		})
+	}
+
+	if len(notifications) == 0 {
+		return 0, nil
+	}
+
+	// Another run for the same day could have got there first
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).
+	             CreateInBatches(notifications, 1000)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return int(result.RowsAffected), nil
+}
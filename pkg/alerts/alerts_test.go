@@ -0,0 +1,105 @@
+package alerts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func price(p float64) *float64 {
+	return &p
+}
+
+func TestTriggered(t *testing.T) {
+	above := models.AlertRule{Direction: models.DirectionAbove, Threshold: price(5)}
+	below := models.AlertRule{Direction: models.DirectionBelow, Threshold: price(5)}
+	rising := models.AlertRule{Direction: models.DirectionAbove, PercentChange: price(20)}
+	falling := models.AlertRule{Direction: models.DirectionBelow, PercentChange: price(20)}
+
+	tests := []struct {
+		name string
+		rule models.AlertRule
+		previous *float64
+		current float64
+		triggered bool
+	}{
+		{"crosses above", above, price(4), 5.5, true},
+		{"stays above", above, price(6), 7, false},
+		{"first price above", above, nil, 6, true},
+		{"crosses below", below, price(6), 4, true},
+		{"stays below", below, price(4), 3, false},
+		{"rises enough", rising, price(10), 12, true},
+		{"rises too little", rising, price(10), 11, false},
+		{"falls enough", falling, price(10), 7.5, true},
+		{"rises when watching for a fall", falling, price(10), 15, false},
+		{"no previous price for percent", rising, nil, 15, false},
+	}
+
+	for _, test := range tests {
+		triggered := Triggered(test.rule, test.previous, test.current)
+		if triggered != test.triggered {
+			t.Fatalf("%s: expected triggered to be %t, got %t", test.name, test.triggered, triggered)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	rule := models.AlertRule{Direction: models.DirectionBelow, PercentChange: price(20), Finish: "foil", Currency: "usd"}
+
+	expected := "Mulldrifter (foil) fell 25.0% from 2.00 usd, it's now 1.50 usd"
+	actual := message("Mulldrifter", rule, price(2), 1.5)
+	if actual != expected {
+		t.Fatalf("Expected \"%s\", got \"%s\"", expected, actual)
+	}
+}
+
+func TestEvaluateTwice(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: conn, DriverName: "postgres"}), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	card_id := "e0fed1e5-fcbd-4597-91b5-ba809571573b"
+	date := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	rules := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "user_id", "card_id", "finish", "currency", "direction", "percent_change"}).
+		       AddRow(1, 1, card_id, "nonfoil", "usd", models.DirectionAbove, 10.0)
+	}
+
+	// The first run fires the rule
+	mock.ExpectQuery(`^SELECT \* FROM "alert_rules" (.+)$`).WillReturnRows(rules())
+	mock.ExpectQuery(`^SELECT "alert_rule_id" FROM "notifications" WHERE date = \$1$`).WithArgs(date).WillReturnRows(sqlmock.NewRows([]string{"alert_rule_id"}))
+	mock.ExpectQuery(`^SELECT \* FROM \(SELECT (.+) WHERE price_snapshots.date = \$1 (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id", "price"}).AddRow(card_id, 12.0))
+	mock.ExpectQuery(`^SELECT \* FROM \(SELECT DISTINCT ON (.+) WHERE price_snapshots.date < \$1 (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"card_id", "price"}).AddRow(card_id, 10.0))
+	mock.ExpectQuery(`^SELECT "name" FROM "cards" WHERE id = \$1 (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Mulldrifter"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^INSERT INTO "notifications" (.+) ON CONFLICT DO NOTHING RETURNING (.+)$`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	// and the second sees it already has and leaves it alone
+	mock.ExpectQuery(`^SELECT \* FROM "alert_rules" (.+)$`).WillReturnRows(rules())
+	mock.ExpectQuery(`^SELECT "alert_rule_id" FROM "notifications" WHERE date = \$1$`).WithArgs(date).WillReturnRows(sqlmock.NewRows([]string{"alert_rule_id"}).AddRow(1))
+
+	for i, expected := range []int{1, 0} {
+		notified, err := Evaluate(db, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if notified != expected {
+			t.Fatalf("Expected run %d to create %d notifications, got %d", i + 1, expected, notified)
+		}
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,32 @@
+package cardname
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Some older cards use ligatures that don't decompose
+// into anything useful so we spell them out ourselves
+var ligatures = strings.NewReplacer(
+	"æ", "ae",
+	"œ", "oe",
+)
+
+// Normalize turns a card name into the form we search against.
+// It's lowercased and has its diacritics removed so that
+// "lim-dul" and "aether" match "Lim-Dûl" and "Æther"
+func Normalize(name string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	normalized, _, err := transform.String(t, strings.ToLower(name))
+	if err != nil {
+		// Transforming a valid string shouldn't ever fail,
+		// but if it does lowercase is close enough
+		normalized = strings.ToLower(name)
+	}
+
+	return ligatures.Replace(strings.TrimSpace(normalized))
+}
@@ -0,0 +1,20 @@
+package cardname
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"Lightning Bolt": "lightning bolt",
+		"Lim-Dûl's Vault": "lim-dul's vault",
+		"Æther Vial": "aether vial",
+		"  Jötun Grunt ": "jotun grunt",
+		"Fire // Ice": "fire // ice",
+	}
+
+	for name, expected := range tests {
+		normalized := Normalize(name)
+		if normalized != expected {
+			t.Fatalf("Expected \"%s\" to normalize to \"%s\", got \"%s\"", name, expected, normalized)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package collectioncsv
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+var (
+	ErrUnknownFormat error = errors.New("Couldn't tell which format the CSV is in")
+	ErrInvalidQuantity error = errors.New("Quantity must be a positive number")
+	ErrUnknownCondition error = errors.New("Unknown condition")
+	ErrInvalidScryfallID error = errors.New("Invalid Scryfall ID")
+)
+
+// Row is a single collection entry as it appears in a CSV file
+type Row struct {
+	Quantity int
+	Name string
+	// Lowercase like our sets
+	SetCode string
+	SetName string
+	CollectorNumber string
+	// One of the models.Finish constants
+	Finish string
+	// Scryfall's language code, "en", "ja" and so on
+	Language string
+	// One of the models.Condition constants
+	Condition string
+	ScryfallID string
+	// Where the row was in the file it was read from
+	Line int
+}
+
+type column struct {
+	header string
+	value func(Row) string
+	read func(*Row, string) error
+}
+
+// Format describes the columns another tool expects in its CSV files
+type Format struct {
+	Name string
+	columns []column
+	// How the tool writes each of our conditions
+	conditions map[string]string
+}
+
+// Names of languages for tools that don't use the codes
+var languageNames = map[string]string{
+	"en": "English",
+	"es": "Spanish",
+	"fr": "French",
+	"de": "German",
+	"it": "Italian",
+	"pt": "Portuguese",
+	"ja": "Japanese",
+	"ko": "Korean",
+	"ru": "Russian",
+	"zhs": "Chinese Simplified",
+	"zht": "Chinese Traditional",
+	"he": "Hebrew",
+	"la": "Latin",
+	"grc": "Ancient Greek",
+	"ar": "Arabic",
+	"sa": "Sanskrit",
+	"ph": "Phyrexian",
+}
+
+var standardConditions = map[string]string{
+	models.ConditionNearMint: "Near Mint",
+	models.ConditionLightlyPlayed: "Lightly Played",
+	models.ConditionModeratelyPlayed: "Moderately Played",
+	models.ConditionHeavilyPlayed: "Heavily Played",
+	models.ConditionDamaged: "Damaged",
+}
+
+func languageName(code string) string {
+	name, ok := languageNames[code]
+	if !ok {
+		return code
+	}
+	return name
+}
+
+func quantity(row Row) string {
+	return strconv.Itoa(row.Quantity)
+}
+
+func readQuantity(row *Row, value string) error {
+	if value == "" {
+		return nil
+	}
+	quantity, err := strconv.Atoi(value)
+	if err != nil || quantity <= 0 {
+		return ErrInvalidQuantity
+	}
+	row.Quantity = quantity
+	return nil
+}
+
+func readName(row *Row, value string) error {
+	row.Name = value
+	return nil
+}
+
+func readSetCode(row *Row, value string) error {
+	row.SetCode = strings.ToLower(value)
+	return nil
+}
+
+func readSetName(row *Row, value string) error {
+	row.SetName = value
+	return nil
+}
+
+func readCollectorNumber(row *Row, value string) error {
+	row.CollectorNumber = value
+	return nil
+}
+
+func readScryfallID(row *Row, value string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := uuid.Parse(value)
+	if err != nil {
+		return ErrInvalidScryfallID
+	}
+	row.ScryfallID = value
+	return nil
+}
+
+func readLanguageCode(row *Row, value string) error {
+	row.Language = strings.ToLower(value)
+	return nil
+}
+
+func readLanguageName(row *Row, value string) error {
+	for code, name := range languageNames {
+		if strings.EqualFold(name, value) {
+			row.Language = code
+			return nil
+		}
+	}
+	// Some tools use the codes anyway
+	return readLanguageCode(row, value)
+}
+
+// Every tool has its own way of saying whether a card is foil,
+// between them they use "", "normal", "Normal", "foil", "Foil" and "etched"
+func readFinish(row *Row, value string) error {
+	switch strings.ToLower(value) {
+	case "", "normal", models.FinishNonfoil:
+		row.Finish = models.FinishNonfoil
+	case models.FinishEtched:
+		row.Finish = models.FinishEtched
+	default:
+		row.Finish = models.FinishFoil
+	}
+	return nil
+}
+
+var (
+	Moxfield = &Format{
+		Name: "moxfield",
+		conditions: standardConditions,
+		columns: []column{
+			{"Count", quantity, readQuantity},
+			{"Name", func(row Row) string { return row.Name }, readName},
+			{"Edition", func(row Row) string { return row.SetCode }, readSetCode},
+			{"Condition", nil, nil},
+			{"Language", func(row Row) string { return languageName(row.Language) }, readLanguageName},
+			{"Foil", func(row Row) string {
+				if row.Finish == models.FinishNonfoil {
+					return ""
+				}
+				return row.Finish
+			}, readFinish},
+			{"Collector Number", func(row Row) string { return row.CollectorNumber }, readCollectorNumber},
+		},
+	}
+
+	Deckbox = &Format{
+		Name: "deckbox",
+		conditions: map[string]string{
+			models.ConditionNearMint: "Near Mint",
+			models.ConditionLightlyPlayed: "Good (Lightly Played)",
+			models.ConditionModeratelyPlayed: "Played",
+			models.ConditionHeavilyPlayed: "Heavily Played",
+			models.ConditionDamaged: "Poor",
+		},
+		columns: []column{
+			{"Count", quantity, readQuantity},
+			{"Name", func(row Row) string { return row.Name }, readName},
+			// Deckbox goes by set names rather than codes
+			{"Edition", func(row Row) string { return row.SetName }, readSetName},
+			{"Card Number", func(row Row) string { return row.CollectorNumber }, readCollectorNumber},
+			{"Condition", nil, nil},
+			{"Language", func(row Row) string { return languageName(row.Language) }, readLanguageName},
+			// Deckbox has no etched foils
+			{"Foil", func(row Row) string {
+				if row.Finish == models.FinishNonfoil {
+					return ""
+				}
+				return "foil"
+			}, readFinish},
+		},
+	}
+
+	ManaBox = &Format{
+		Name: "manabox",
+		conditions: map[string]string{
+			models.ConditionNearMint: "near_mint",
+			models.ConditionLightlyPlayed: "light_played",
+			models.ConditionModeratelyPlayed: "played",
+			models.ConditionHeavilyPlayed: "poor",
+			models.ConditionDamaged: "poor",
+		},
+		columns: []column{
+			{"Name", func(row Row) string { return row.Name }, readName},
+			{"Set code", func(row Row) string { return strings.ToUpper(row.SetCode) }, readSetCode},
+			{"Set name", func(row Row) string { return row.SetName }, readSetName},
+			{"Collector number", func(row Row) string { return row.CollectorNumber }, readCollectorNumber},
+			{"Foil", func(row Row) string {
+				if row.Finish == models.FinishNonfoil {
+					return "normal"
+				}
+				return row.Finish
+			}, readFinish},
+			{"Quantity", quantity, readQuantity},
+			{"Scryfall ID", func(row Row) string { return row.ScryfallID }, readScryfallID},
+			{"Condition", nil, nil},
+			{"Language", func(row Row) string { return row.Language }, readLanguageCode},
+		},
+	}
+
+	TCGplayer = &Format{
+		Name: "tcgplayer",
+		conditions: standardConditions,
+		columns: []column{
+			{"Quantity", quantity, readQuantity},
+			{"Name", func(row Row) string { return row.Name }, readName},
+			{"Set", func(row Row) string { return row.SetName }, readSetName},
+			{"Card Number", func(row Row) string { return row.CollectorNumber }, readCollectorNumber},
+			{"Set Code", func(row Row) string { return strings.ToUpper(row.SetCode) }, readSetCode},
+			{"Printing", func(row Row) string {
+				if row.Finish == models.FinishNonfoil {
+					return "Normal"
+				}
+				return "Foil"
+			}, readFinish},
+			{"Condition", nil, nil},
+			{"Language", func(row Row) string { return languageName(row.Language) }, readLanguageName},
+		},
+	}
+
+	formats = []*Format{Moxfield, Deckbox, ManaBox, TCGplayer}
+)
+
+// Detect works out the format of a CSV file from its header. Other tools
+// export more columns than we do, so we pick the first format whose
+// columns are all in header.
+func Detect(header []string) (*Format, bool) {
+	for _, format := range formats {
+		if format.matches(header) {
+			return format, true
+		}
+	}
+	return nil, false
+}
+
+func (format *Format) matches(header []string) bool {
+	for _, column := range format.columns {
+		found := false
+		for _, name := range header {
+			if strings.TrimSpace(name) == column.header {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup finds a format by its name, ignoring case
+func Lookup(name string) (*Format, bool) {
+	for _, format := range formats {
+		if strings.EqualFold(format.Name, name) {
+			return format, true
+		}
+	}
+	return nil, false
+}
+
+func (format *Format) header() []string {
+	header := make([]string, len(format.columns))
+	for i, column := range format.columns {
+		header[i] = column.header
+	}
+	return header
+}
+
+func (format *Format) record(row Row) []string {
+	record := make([]string, len(format.columns))
+	for i, column := range format.columns {
+		// Every format has its own names for conditions
+		if column.value == nil {
+			record[i] = format.conditions[row.Condition]
+		} else {
+			record[i] = column.value(row)
+		}
+	}
+	return record
+}
+
+// Writer writes rows as CSV in a format. Rows are written
+// as they come rather than held on to, so it's fine to
+// use for collections of any size.
+type Writer struct {
+	format *Format
+	csv *csv.Writer
+	wroteHeader bool
+}
+
+func NewWriter(w io.Writer, format *Format) *Writer {
+	return &Writer{
+		format: format,
+		csv: csv.NewWriter(w),
+	}
+}
+
+func (w *Writer) writeHeader() error {
+	if w.wroteHeader {
+		return nil
+	}
+	w.wroteHeader = true
+	return w.csv.Write(w.format.header())
+}
+
+func (w *Writer) Write(row Row) error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+	return w.csv.Write(w.format.record(row))
+}
+
+// Flush writes anything buffered, including the header
+// if no rows were written
+func (w *Writer) Flush() error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+func (format *Format) readCondition(row *Row, value string) error {
+	if value == "" {
+		row.Condition = models.ConditionNearMint
+		return nil
+	}
+
+	// TCGplayer tacks the printing onto the condition
+	value = strings.TrimSuffix(value, " Foil")
+	if models.IsCondition(value) {
+		row.Condition = value
+		return nil
+	}
+	// Conditions that share a name are listed from best to worst,
+	// which is what we want ManaBox's poor to come back as
+	for _, condition := range conditions {
+		if strings.EqualFold(format.conditions[condition], value) {
+			row.Condition = condition
+			return nil
+		}
+	}
+	return ErrUnknownCondition
+}
+
+// Our conditions from best to worst
+var conditions = []string{
+	models.ConditionNearMint,
+	models.ConditionLightlyPlayed,
+	models.ConditionModeratelyPlayed,
+	models.ConditionHeavilyPlayed,
+	models.ConditionDamaged,
+}
+
+// RowError is returned by Reader.Read when a row has
+// a value we don't understand. It's fine to keep reading after one.
+type RowError struct {
+	Line int
+	Column string
+	Err error
+}
+
+func (err *RowError) Error() string {
+	return fmt.Sprintf("line %d, column \"%s\": %s", err.Line, err.Column, err.Err.Error())
+}
+
+func (err *RowError) Unwrap() error {
+	return err.Err
+}
+
+// Reader reads rows from a CSV file exported by another tool
+type Reader struct {
+	Format *Format
+	csv *csv.Reader
+	// Where each of Format's columns is in the file, -1 when it's missing
+	indexes []int
+}
+
+// NewReader reads the header of r and works out which columns are
+// where. If format is nil it's detected from the header.
+func NewReader(r io.Reader, format *Format) (*Reader, error) {
+	reader := csv.NewReader(r)
+	// Rows with missing trailing columns are common enough in
+	// hand edited files that we don't want to reject them
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, ErrUnknownFormat
+	} else if err != nil {
+		return nil, err
+	}
+	// Excel likes to start files with a byte order mark
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	if format == nil {
+		var ok bool
+		format, ok = Detect(header)
+		if !ok {
+			return nil, ErrUnknownFormat
+		}
+	}
+
+	indexes := make([]int, len(format.columns))
+	for i, column := range format.columns {
+		indexes[i] = -1
+		for j, name := range header {
+			if strings.TrimSpace(name) == column.header {
+				indexes[i] = j
+				break
+			}
+		}
+	}
+
+	return &Reader{
+		Format: format,
+		csv: reader,
+		indexes: indexes,
+	}, nil
+}
+
+// Read returns the next row, or io.EOF when there are no more.
+// Rows without a quantity are taken to be a single copy.
+func (r *Reader) Read() (Row, error) {
+	record, err := r.csv.Read()
+	if err != nil {
+		return Row{}, err
+	}
+	line, _ := r.csv.FieldPos(0)
+
+	row := Row{
+		Line: line,
+		Quantity: 1,
+		Finish: models.FinishNonfoil,
+		Condition: models.ConditionNearMint,
+	}
+	for i, column := range r.Format.columns {
+		index := r.indexes[i]
+		if index == -1 || index >= len(record) {
+			continue
+		}
+
+		value := strings.TrimSpace(record[index])
+		if column.read == nil {
+			err = r.Format.readCondition(&row, value)
+		} else {
+			err = column.read(&row, value)
+		}
+		if err != nil {
+			return row, &RowError{Line: line, Column: column.header, Err: err}
+		}
+	}
+
+	return row, nil
+}
@@ -0,0 +1,165 @@
+package collectioncsv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+var mulldrifter = Row{
+	Quantity: 4,
+	Name: "Mulldrifter",
+	SetCode: "ima",
+	SetName: "Iconic Masters",
+	CollectorNumber: "59",
+	Finish: models.FinishFoil,
+	Language: "ja",
+	Condition: models.ConditionLightlyPlayed,
+	ScryfallID: "e0fed1e5-fcbd-4597-91b5-ba809571573b",
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		format *Format
+		expected string
+	}{
+		{
+			Moxfield,
+			"Count,Name,Edition,Condition,Language,Foil,Collector Number\n" +
+			"4,Mulldrifter,ima,Lightly Played,Japanese,foil,59\n",
+		},
+		{
+			Deckbox,
+			"Count,Name,Edition,Card Number,Condition,Language,Foil\n" +
+			"4,Mulldrifter,Iconic Masters,59,Good (Lightly Played),Japanese,foil\n",
+		},
+		{
+			ManaBox,
+			"Name,Set code,Set name,Collector number,Foil,Quantity,Scryfall ID,Condition,Language\n" +
+			"Mulldrifter,IMA,Iconic Masters,59,foil,4,e0fed1e5-fcbd-4597-91b5-ba809571573b,light_played,ja\n",
+		},
+		{
+			TCGplayer,
+			"Quantity,Name,Set,Card Number,Set Code,Printing,Condition,Language\n" +
+			"4,Mulldrifter,Iconic Masters,59,IMA,Foil,Lightly Played,Japanese\n",
+		},
+	}
+
+	for _, test := range tests {
+		var buffer bytes.Buffer
+		writer := NewWriter(&buffer, test.format)
+		err := writer.Write(mulldrifter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writer.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if buffer.String() != test.expected {
+			t.Fatalf("%s: expected %q, got %q", test.format.Name, test.expected, buffer.String())
+		}
+	}
+}
+
+func TestWriteNothing(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewWriter(&buffer, Moxfield)
+	err := writer.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Count,Name,Edition,Condition,Language,Foil,Collector Number\n"
+	if buffer.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buffer.String())
+	}
+}
+
+func TestLookup(t *testing.T) {
+	format, ok := Lookup("ManaBox")
+	if !ok || format != ManaBox {
+		t.Fatal("Expected to find ManaBox")
+	}
+
+	_, ok = Lookup("spreadsheet")
+	if ok {
+		t.Fatal("Didn't expect to find a format called spreadsheet")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range formats {
+		var buffer bytes.Buffer
+		writer := NewWriter(&buffer, format)
+		err := writer.Write(mulldrifter)
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := NewReader(&buffer, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", format.Name, err.Error())
+		} else if reader.Format != format {
+			t.Fatalf("%s: detected format %s", format.Name, reader.Format.Name)
+		}
+
+		row, err := reader.Read()
+		if err != nil {
+			t.Fatalf("%s: %s", format.Name, err.Error())
+		}
+
+		// Not every format has every field
+		if row.Quantity != 4 || row.Name != "Mulldrifter" || row.CollectorNumber != "59" ||
+		   row.Finish != models.FinishFoil || row.Language != "ja" || row.Condition != models.ConditionLightlyPlayed {
+			t.Fatalf("%s: unexpected row %+v", format.Name, row)
+		}
+
+		_, err = reader.Read()
+		if err != io.EOF {
+			t.Fatalf("%s: expected EOF, got %v", format.Name, err)
+		}
+	}
+}
+
+func TestReadExtraColumns(t *testing.T) {
+	file := "\ufeffQuantity,Name,Simple Name,Set,Card Number,Set Code,Printing,Condition,Language,Rarity,Product ID,SKU\n" +
+	        "2,Mulldrifter,Mulldrifter,Iconic Masters,59,IMA,Foil,Near Mint Foil,English,Uncommon,123,456\n" +
+	        "0,Mulldrifter,Mulldrifter,Iconic Masters,59,IMA,Normal,Mint,English,Uncommon,123,456\n"
+
+	reader, err := NewReader(strings.NewReader(file), nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if reader.Format != TCGplayer {
+		t.Fatalf("Expected tcgplayer, got %s", reader.Format.Name)
+	}
+
+	row, err := reader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.Quantity != 2 || row.SetCode != "ima" || row.Finish != models.FinishFoil || row.Condition != models.ConditionNearMint {
+		t.Fatalf("Unexpected row %+v", row)
+	}
+
+	_, err = reader.Read()
+	var rowError *RowError
+	if !errors.As(err, &rowError) || rowError.Line != 3 || !errors.Is(err, ErrInvalidQuantity) {
+		t.Fatalf("Expected an invalid quantity on line 3, got %v", err)
+	}
+}
+
+func TestReadUnknownFormat(t *testing.T) {
+	_, err := NewReader(strings.NewReader("Card,Amount\nMulldrifter,4\n"), nil)
+	if err != ErrUnknownFormat {
+		t.Fatalf("Expected ErrUnknownFormat, got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package decklist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+const (
+	SectionMain = ""
+	SectionSideboard = "sideboard"
+	SectionCommander = "commander"
+	SectionCompanion = "companion"
+	SectionMaybeboard = "maybeboard"
+)
+
+var (
+	ErrInvalidLine error = errors.New("Expected a line like \"4 Lightning Bolt (M10) 146\"")
+
+	// Matches lines like "4 Lightning Bolt", "4x Lightning Bolt (M10) 146" or "1 Lightning Bolt (2XM) 117 *F*"
+	cardLine = regexp.MustCompile(`^(\d+)x?\s+(.+?)(?:\s+\(([A-Za-z0-9_]+)\)(?:\s+([^\s*]+))?)?(?:\s+\*([FE])\*)?$`)
+	// MTGO writes split cards as "Fire/Ice" where everything else uses "Fire // Ice"
+	splitName = regexp.MustCompile(`^([^/]+?)\s*/{1,2}\s*([^/]+)$`)
+
+	// Arena and Scryfall don't always agree on set codes
+	arenaSetCodes = map[string]string{
+		"dar": "dom",
+		"mps_akh": "mp2",
+		"mps_kld": "mps",
+		"mps_grn": "med",
+		"mps_rna": "med",
+		"mps_war": "med",
+	}
+
+	// Headers that start a new section. Arena uses "Deck" for the main deck
+	sectionHeaders = map[string]string{
+		"deck": SectionMain,
+		"main": SectionMain,
+		"maindeck": SectionMain,
+		"mainboard": SectionMain,
+		"sideboard": SectionSideboard,
+		"commander": SectionCommander,
+		"companion": SectionCompanion,
+		"maybeboard": SectionMaybeboard,
+	}
+)
+
+// Entry is one line of a decklist
+type Entry struct {
+	Line int
+	Quantity int
+	// Split cards are always "Fire // Ice", whichever way they were written
+	Name string
+	// Lowercase and translated from Arena's codes
+	SetCode string
+	CollectorNumber string
+	// One of the models.Finish constants
+	Finish string
+	Section string
+}
+
+// LineError is a line Parse couldn't make sense of
+type LineError struct {
+	Line int
+	Text string
+	Err error
+}
+
+func (err LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", err.Line, err.Err.Error())
+}
+
+// SetCode translates an Arena set code into Scryfall's
+func SetCode(code string) string {
+	code = strings.ToLower(code)
+	translated, ok := arenaSetCodes[code]
+	if ok {
+		return translated
+	}
+	return code
+}
+
+// Name puts split card names in the "Fire // Ice" form Scryfall uses
+func Name(name string) string {
+	matches := splitName.FindStringSubmatch(name)
+	if matches == nil {
+		return name
+	}
+	return matches[1] + " // " + matches[2]
+}
+
+func section(line string) (string, bool) {
+	header := strings.ToLower(strings.TrimSuffix(line, ":"))
+	section, ok := sectionHeaders[header]
+	return section, ok
+}
+
+// Parse reads a decklist in the format MTGO, Arena and most deck
+// builders export. Lines it doesn't understand are returned as errors
+// alongside everything it did understand.
+func Parse(r io.Reader) ([]Entry, []LineError, error) {
+	var entries []Entry
+	var lineErrors []LineError
+
+	current := SectionMain
+	sawCards := false
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if number == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+
+		// MTGO separates the sideboard with a blank line
+		if line == "" {
+			if sawCards && current == SectionMain {
+				current = SectionSideboard
+			}
+			continue
+		}
+		// Comments and Arena's metadata like "Name Mono Red"
+		if strings.HasPrefix(line, "//") || strings.HasPrefix(line, "#") ||
+		   strings.HasPrefix(line, "About") || strings.HasPrefix(line, "Name ") {
+			continue
+		}
+		if newSection, ok := section(line); ok {
+			current = newSection
+			sawCards = false
+			continue
+		}
+
+		entrySection := current
+		// .dec files mark sideboard cards on each line
+		if strings.HasPrefix(line, "SB:") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "SB:"))
+			entrySection = SectionSideboard
+		}
+
+		matches := cardLine.FindStringSubmatch(line)
+		if matches == nil {
+			lineErrors = append(lineErrors, LineError{Line: number, Text: line, Err: ErrInvalidLine})
+			continue
+		}
+
+		quantity, err := strconv.Atoi(matches[1])
+		if err != nil || quantity <= 0 {
+			lineErrors = append(lineErrors, LineError{Line: number, Text: line, Err: ErrInvalidLine})
+			continue
+		}
+
+		finish := models.FinishNonfoil
+		if matches[5] == "F" {
+			finish = models.FinishFoil
+		} else if matches[5] == "E" {
+			finish = models.FinishEtched
+		}
+
+		entries = append(entries, Entry{
+			Line: number,
+			Quantity: quantity,
+			Name: Name(matches[2]),
+			SetCode: SetCode(matches[3]),
+			CollectorNumber: matches[4],
+			Finish: finish,
+			Section: entrySection,
+		})
+		sawCards = true
+	}
+
+	return entries, lineErrors, scanner.Err()
+}
+
+// Writer writes a decklist that Parse, MTGO and Arena can all read.
+// Entries should be written grouped by section.
+type Writer struct {
+	w *bufio.Writer
+	section string
+	wroteAny bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+func (w *Writer) Write(entry Entry) error {
+	if entry.Section != w.section || !w.wroteAny && entry.Section != SectionMain {
+		if w.wroteAny {
+			_, err := w.w.WriteString("\n")
+			if err != nil {
+				return err
+			}
+		}
+		header := "Deck"
+		if entry.Section != SectionMain {
+			header = strings.ToUpper(entry.Section[:1]) + entry.Section[1:]
+		}
+		_, err := w.w.WriteString(header + "\n")
+		if err != nil {
+			return err
+		}
+		w.section = entry.Section
+	}
+	w.wroteAny = true
+
+	line := strconv.Itoa(entry.Quantity) + " " + entry.Name
+	if entry.SetCode != "" {
+		line += " (" + strings.ToUpper(entry.SetCode) + ")"
+		if entry.CollectorNumber != "" {
+			line += " " + entry.CollectorNumber
+		}
+	}
+	if entry.Finish == models.FinishFoil {
+		line += " *F*"
+	} else if entry.Finish == models.FinishEtched {
+		line += " *E*"
+	}
+
+	_, err := w.w.WriteString(line + "\n")
+	return err
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
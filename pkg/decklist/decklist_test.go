@@ -0,0 +1,101 @@
+package decklist
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+func TestParse(t *testing.T) {
+	list := "Deck\n" +
+	        "4 Lightning Bolt (M10) 146\n" +
+	        "2x Fire/Ice\n" +
+	        "1 Llanowar Elves (DAR) 168 *F*\n" +
+	        "Counterspell\n" +
+	        "\n" +
+	        "3 Duress (M19) 94\n" +
+	        "SB: 1 Negate\n"
+
+	entries, lineErrors, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Entry{
+		{Line: 2, Quantity: 4, Name: "Lightning Bolt", SetCode: "m10", CollectorNumber: "146", Finish: models.FinishNonfoil},
+		{Line: 3, Quantity: 2, Name: "Fire // Ice", Finish: models.FinishNonfoil},
+		{Line: 4, Quantity: 1, Name: "Llanowar Elves", SetCode: "dom", CollectorNumber: "168", Finish: models.FinishFoil},
+		{Line: 7, Quantity: 3, Name: "Duress", SetCode: "m19", CollectorNumber: "94", Finish: models.FinishNonfoil, Section: SectionSideboard},
+		{Line: 8, Quantity: 1, Name: "Negate", Finish: models.FinishNonfoil, Section: SectionSideboard},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d: %+v", len(expected), len(entries), entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Fatalf("Expected %+v, got %+v", expected[i], entries[i])
+		}
+	}
+
+	if len(lineErrors) != 1 || lineErrors[0].Line != 5 {
+		t.Fatalf("Expected an error on line 5, got %+v", lineErrors)
+	}
+}
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		name string
+		expected string
+	}{
+		{"Fire // Ice", "Fire // Ice"},
+		{"Fire/Ice", "Fire // Ice"},
+		{"Fire / Ice", "Fire // Ice"},
+		{"Lightning Bolt", "Lightning Bolt"},
+	}
+
+	for _, test := range tests {
+		actual := Name(test.name)
+		if actual != test.expected {
+			t.Fatalf("Expected \"%s\", got \"%s\"", test.expected, actual)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewWriter(&buffer)
+	entries := []Entry{
+		{Quantity: 4, Name: "Lightning Bolt", SetCode: "m10", CollectorNumber: "146", Finish: models.FinishNonfoil},
+		{Quantity: 1, Name: "Fire // Ice", SetCode: "mh2", CollectorNumber: "290", Finish: models.FinishEtched},
+		{Quantity: 2, Name: "Negate", Finish: models.FinishNonfoil, Section: SectionSideboard},
+	}
+	for _, entry := range entries {
+		err := writer.Write(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "4 Lightning Bolt (M10) 146\n" +
+	            "1 Fire // Ice (MH2) 290 *E*\n" +
+	            "\n" +
+	            "Sideboard\n" +
+	            "2 Negate\n"
+	if buffer.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buffer.String())
+	}
+
+	parsed, _, err := Parse(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 3 || parsed[2].Section != SectionSideboard || parsed[1].Finish != models.FinishEtched {
+		t.Fatalf("Couldn't read back what was written, got %+v", parsed)
+	}
+}
@@ -0,0 +1,43 @@
+package decks
+
+import (
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+// CardOwnership is how many copies of a card a deck
+// needs and how many of them a collection has
+type CardOwnership struct {
+	OracleID uuid.UUID `json:"oracle_id"`
+	Name string `json:"name"`
+	Needed int `json:"needed"`
+	Owned int `json:"owned"`
+	Missing int `json:"missing"`
+}
+
+// Ownership works out which of a deck's cards are covered by owned,
+// the copies in a collection of each oracle card. A card in more than
+// one zone needs the copies for all of them, but the maybeboard is only
+// ideas so it isn't needed. Cards come out in the order the deck has them.
+func Ownership(cards []models.DeckCard, owned map[uuid.UUID]int) ([]CardOwnership, int) {
+	var ownership []CardOwnership
+	index := make(map[uuid.UUID]int)
+	for _, card := range cards {
+		if card.Zone == models.ZoneMaybe {
+			continue
+		}
+		if _, ok := index[card.OracleID]; !ok {
+			index[card.OracleID] = len(ownership)
+			ownership = append(ownership, CardOwnership{OracleID: card.OracleID, Name: card.Name})
+		}
+		ownership[index[card.OracleID]].Needed += card.Quantity
+	}
+
+	missing := 0
+	for i := range ownership {
+		ownership[i].Owned = owned[ownership[i].OracleID]
+		ownership[i].Missing = max(ownership[i].Needed - ownership[i].Owned, 0)
+		missing += ownership[i].Missing
+	}
+	return ownership, missing
+}
@@ -0,0 +1,39 @@
+package decks
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+func TestOwnership(t *testing.T) {
+	bolt := uuid.New()
+	counterspell := uuid.New()
+	brainstorm := uuid.New()
+
+	cards := []models.DeckCard{
+		{OracleID: bolt, Name: "Lightning Bolt", Zone: models.ZoneMain, Quantity: 4},
+		{OracleID: counterspell, Name: "Counterspell", Zone: models.ZoneMain, Quantity: 2},
+		// Needs the sideboard copies too
+		{OracleID: bolt, Name: "Lightning Bolt", Zone: models.ZoneSide, Quantity: 1},
+		// Only an idea
+		{OracleID: brainstorm, Name: "Brainstorm", Zone: models.ZoneMaybe, Quantity: 4},
+	}
+	owned := map[uuid.UUID]int{bolt: 3, counterspell: 6}
+
+	ownership, missing := Ownership(cards, owned)
+
+	if len(ownership) != 2 {
+		t.Fatalf("Expected 2 cards, got %+v", ownership)
+	}
+	if ownership[0].OracleID != bolt || ownership[0].Needed != 5 || ownership[0].Owned != 3 || ownership[0].Missing != 2 {
+		t.Fatalf("Unexpected ownership of Lightning Bolt %+v", ownership[0])
+	}
+	if ownership[1].OracleID != counterspell || ownership[1].Needed != 2 || ownership[1].Missing != 0 {
+		t.Fatalf("Unexpected ownership of Counterspell %+v", ownership[1])
+	}
+	if missing != 2 {
+		t.Fatalf("Expected 2 missing, got %d", missing)
+	}
+}
@@ -0,0 +1,289 @@
+package decks
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+// The rules a Violation can break
+const (
+	RuleDeckSize = "deck_size"
+	RuleSideboardSize = "sideboard_size"
+	RuleCopies = "copies"
+	RuleRestricted = "restricted"
+	RuleBanned = "banned"
+	RuleNotLegal = "not_legal"
+	RuleCommander = "commander"
+	RuleColorIdentity = "color_identity"
+)
+
+// Format is the deck building rules of a format
+type Format struct {
+	// Scryfall's name for it, which is what legalities use
+	Name string
+	// How many cards the deck needs, counting commanders.
+	// Decks can be any bigger than MinSize when MaxSize is 0.
+	MinSize int
+	MaxSize int
+	MaxSideboard int
+	// How many copies of a card are allowed
+	CopyLimit int
+	// Whether the deck is led by a commander it has to share colors with
+	Commander bool
+	// Whether planeswalkers can be commanders as well as creatures
+	PlaneswalkerCommanders bool
+}
+
+var constructed = Format{MinSize: 60, MaxSideboard: 15, CopyLimit: 4}
+var commander = Format{MinSize: 100, MaxSize: 100, CopyLimit: 1, Commander: true}
+
+// Formats are the formats decks can be checked against, by name
+var Formats = map[string]Format{
+	"standard": named("standard", constructed),
+	"pioneer": named("pioneer", constructed),
+	"modern": named("modern", constructed),
+	"legacy": named("legacy", constructed),
+	"vintage": named("vintage", constructed),
+	"pauper": named("pauper", constructed),
+	"penny": named("penny", constructed),
+	"historic": named("historic", constructed),
+	"explorer": named("explorer", constructed),
+	"timeless": named("timeless", constructed),
+	"alchemy": named("alchemy", constructed),
+	"premodern": named("premodern", constructed),
+	"commander": named("commander", commander),
+	"duel": named("duel", commander),
+	"paupercommander": named("paupercommander", commander),
+	"brawl": {Name: "brawl", MinSize: 100, MaxSize: 100, CopyLimit: 1, Commander: true, PlaneswalkerCommanders: true},
+	"standardbrawl": {Name: "standardbrawl", MinSize: 60, MaxSize: 60, CopyLimit: 1, Commander: true, PlaneswalkerCommanders: true},
+}
+
+func named(name string, format Format) Format {
+	format.Name = name
+	return format
+}
+
+// IsFormat says whether there are rules for a format called name
+func IsFormat(name string) bool {
+	_, ok := Formats[name]
+	return ok
+}
+
+// CardInfo is what the rules need to know about a card
+type CardInfo struct {
+	Name string
+	// Every face's, for cards with more than one
+	TypeLine string
+	OracleText string
+	ColorIdentity []string
+	// Its legality in the format being checked, "legal", "restricted"
+	// or "banned", or empty when it isn't legal there at all
+	Status string
+}
+
+// Violation is a rule a deck or card breaks
+type Violation struct {
+	// One of the Rule constants
+	Rule string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// CardViolations are the rules a single card in a deck breaks
+type CardViolations struct {
+	OracleID uuid.UUID `json:"oracle_id"`
+	Name string `json:"name"`
+	Violations []Violation `json:"violations"`
+}
+
+// Legality is what's wrong with a deck in a format, if anything
+type Legality struct {
+	Format string `json:"format"`
+	Legal bool `json:"legal"`
+	// Problems with the deck as a whole, like its size
+	Deck []Violation `json:"deck"`
+	Cards []CardViolations `json:"cards"`
+}
+
+// Some cards say how many copies of them a deck can have
+var anyNumberPattern = regexp.MustCompile(`(?i)a deck can have any number of cards named`)
+var upToPattern = regexp.MustCompile(`(?i)a deck can have up to (\w+) cards named`)
+
+var numberWords = map[string]int{
+	"two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+	"seven": 7, "eight": 8, "nine": 9, "ten": 10,
+}
+
+// How many copies of info a deck in format can have, 0 for any number
+func copyLimit(format Format, info CardInfo) int {
+	if strings.Contains(info.TypeLine, "Basic") && strings.Contains(info.TypeLine, "Land") {
+		return 0
+	}
+	if anyNumberPattern.MatchString(info.OracleText) {
+		return 0
+	}
+	if match := upToPattern.FindStringSubmatch(info.OracleText); match != nil {
+		if limit, ok := numberWords[strings.ToLower(match[1])]; ok {
+			return limit
+		}
+	}
+	if info.Status == "restricted" {
+		return 1
+	}
+	return format.CopyLimit
+}
+
+// Whether info is allowed to lead a deck in format
+func canBeCommander(format Format, info CardInfo) bool {
+	// Backgrounds lead alongside a commander that chooses one
+	if strings.Contains(info.OracleText, "can be your commander") || strings.Contains(info.TypeLine, "Background") {
+		return true
+	}
+	if !strings.Contains(info.TypeLine, "Legendary") {
+		return false
+	}
+	return strings.Contains(info.TypeLine, "Creature") ||
+	       (format.PlaneswalkerCommanders && strings.Contains(info.TypeLine, "Planeswalker"))
+}
+
+// Whether a card can share the command zone with another commander
+func hasPartner(info CardInfo) bool {
+	return strings.Contains(info.OracleText, "Partner") ||
+	       strings.Contains(info.OracleText, "Friends forever") ||
+	       strings.Contains(info.OracleText, "Choose a Background") ||
+	       strings.Contains(info.TypeLine, "Background")
+}
+
+// Validate checks cards against the rules of format. info has what's
+// known about each oracle card in the deck, cards without any are
+// taken not to be legal. The maybeboard isn't part of the deck so
+// nothing in it is checked.
+func Validate(format Format, cards []models.DeckCard, info map[uuid.UUID]CardInfo) Legality {
+	legality := Legality{Format: format.Name, Deck: []Violation{}, Cards: []CardViolations{}}
+
+	size, sideboard := 0, 0
+	copies := make(map[uuid.UUID]int)
+	var order, commanders []uuid.UUID
+	for _, card := range cards {
+		switch card.Zone {
+		case models.ZoneMaybe:
+			continue
+		case models.ZoneSide:
+			sideboard += card.Quantity
+		case models.ZoneCommander:
+			size += card.Quantity
+			for i := 0; i < card.Quantity; i++ {
+				commanders = append(commanders, card.OracleID)
+			}
+		default:
+			size += card.Quantity
+		}
+		if _, ok := copies[card.OracleID]; !ok {
+			order = append(order, card.OracleID)
+		}
+		copies[card.OracleID] += card.Quantity
+	}
+
+	if size < format.MinSize {
+		legality.Deck = append(legality.Deck, Violation{
+			Rule: RuleDeckSize,
+			Message: fmt.Sprintf("Needs at least %d cards, has %d", format.MinSize, size),
+		})
+	}
+	if format.MaxSize > 0 && size > format.MaxSize {
+		legality.Deck = append(legality.Deck, Violation{
+			Rule: RuleDeckSize,
+			Message: fmt.Sprintf("Can't have more than %d cards, has %d", format.MaxSize, size),
+		})
+	}
+	if sideboard > format.MaxSideboard {
+		legality.Deck = append(legality.Deck, Violation{
+			Rule: RuleSideboardSize,
+			Message: fmt.Sprintf("Sideboards can't have more than %d cards, has %d", format.MaxSideboard, sideboard),
+		})
+	}
+
+	// The colors the commanders allow, nil when it isn't a commander format
+	var identity map[string]bool
+	if format.Commander {
+		identity = make(map[string]bool)
+		for _, id := range commanders {
+			for _, color := range info[id].ColorIdentity {
+				identity[color] = true
+			}
+		}
+
+		if len(commanders) == 0 {
+			legality.Deck = append(legality.Deck, Violation{Rule: RuleCommander, Message: "Needs a commander"})
+		} else if len(commanders) > 2 || (len(commanders) == 2 && (!hasPartner(info[commanders[0]]) || !hasPartner(info[commanders[1]]))) {
+			legality.Deck = append(legality.Deck, Violation{
+				Rule: RuleCommander,
+				Message: "Only two commanders that can partner with each other can share the command zone",
+			})
+		}
+	} else if len(commanders) > 0 {
+		legality.Deck = append(legality.Deck, Violation{
+			Rule: RuleCommander,
+			Message: fmt.Sprintf("There are no commanders in %s", format.Name),
+		})
+	}
+
+	isCommander := make(map[uuid.UUID]bool)
+	for _, id := range commanders {
+		isCommander[id] = true
+	}
+
+	for _, id := range order {
+		card := info[id]
+		var violations []Violation
+
+		switch card.Status {
+		case "banned":
+			violations = append(violations, Violation{Rule: RuleBanned, Message: fmt.Sprintf("Banned in %s", format.Name)})
+		case "legal", "restricted":
+		default:
+			violations = append(violations, Violation{Rule: RuleNotLegal, Message: fmt.Sprintf("Not legal in %s", format.Name)})
+		}
+
+		if limit := copyLimit(format, card); limit > 0 && copies[id] > limit {
+			rule := RuleCopies
+			if card.Status == "restricted" {
+				rule = RuleRestricted
+			}
+			violations = append(violations, Violation{
+				Rule: rule,
+				Message: fmt.Sprintf("Only %d allowed, has %d", limit, copies[id]),
+			})
+		}
+
+		if format.Commander && isCommander[id] && !canBeCommander(format, card) {
+			violations = append(violations, Violation{Rule: RuleCommander, Message: "Can't be a commander"})
+		}
+		if identity != nil && len(commanders) > 0 {
+			var outside []string
+			for _, color := range card.ColorIdentity {
+				if !identity[color] {
+					outside = append(outside, color)
+				}
+			}
+			if len(outside) > 0 {
+				sort.Strings(outside)
+				violations = append(violations, Violation{
+					Rule: RuleColorIdentity,
+					Message: fmt.Sprintf("%s is outside the commander's color identity", strings.Join(outside, "")),
+				})
+			}
+		}
+
+		if len(violations) > 0 {
+			legality.Cards = append(legality.Cards, CardViolations{OracleID: id, Name: card.Name, Violations: violations})
+		}
+	}
+
+	legality.Legal = len(legality.Deck) == 0 && len(legality.Cards) == 0
+	return legality
+}
@@ -0,0 +1,165 @@
+package decks
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+// Finds the violations for a card, nil if it hasn't got any
+func cardViolations(legality Legality, id uuid.UUID) []Violation {
+	for _, card := range legality.Cards {
+		if card.OracleID == id {
+			return card.Violations
+		}
+	}
+	return nil
+}
+
+func TestValidateConstructed(t *testing.T) {
+	bolt := uuid.New()
+	mountain := uuid.New()
+	rats := uuid.New()
+	lotus := uuid.New()
+	jace := uuid.New()
+	unknown := uuid.New()
+
+	cards := []models.DeckCard{
+		{OracleID: bolt, Zone: models.ZoneMain, Quantity: 4},
+		{OracleID: bolt, Zone: models.ZoneSide, Quantity: 1},
+		{OracleID: mountain, Zone: models.ZoneMain, Quantity: 33},
+		{OracleID: rats, Zone: models.ZoneMain, Quantity: 20},
+		{OracleID: lotus, Zone: models.ZoneMain, Quantity: 2},
+		{OracleID: jace, Zone: models.ZoneMain, Quantity: 1},
+		// Not part of the deck so it doesn't matter
+		{OracleID: unknown, Zone: models.ZoneMaybe, Quantity: 8},
+	}
+	info := map[uuid.UUID]CardInfo{
+		bolt: {Name: "Lightning Bolt", TypeLine: "Instant", Status: "legal"},
+		mountain: {Name: "Mountain", TypeLine: "Basic Land — Mountain", Status: "legal"},
+		rats: {Name: "Relentless Rats", TypeLine: "Creature — Rat", OracleText: "A deck can have any number of cards named Relentless Rats.", Status: "legal"},
+		lotus: {Name: "Black Lotus", TypeLine: "Artifact", Status: "restricted"},
+		jace: {Name: "Jace, the Mind Sculptor", TypeLine: "Legendary Planeswalker — Jace", Status: "banned"},
+	}
+
+	legality := Validate(Formats["vintage"], cards, info)
+
+	if legality.Legal {
+		t.Fatal("Expected the deck not to be legal")
+	}
+	if len(legality.Deck) != 0 {
+		t.Fatalf("Expected no problems with the deck as a whole, got %+v", legality.Deck)
+	}
+	if len(legality.Cards) != 3 {
+		t.Fatalf("Expected 3 cards with violations, got %+v", legality.Cards)
+	}
+
+	violations := cardViolations(legality, bolt)
+	if len(violations) != 1 || violations[0].Rule != RuleCopies {
+		t.Fatalf("Expected sideboard copies of Lightning Bolt to count, got %+v", violations)
+	}
+	violations = cardViolations(legality, lotus)
+	if len(violations) != 1 || violations[0].Rule != RuleRestricted {
+		t.Fatalf("Expected Black Lotus to be restricted, got %+v", violations)
+	}
+	violations = cardViolations(legality, jace)
+	if len(violations) != 1 || violations[0].Rule != RuleBanned {
+		t.Fatalf("Expected Jace to be banned, got %+v", violations)
+	}
+}
+
+func TestValidateDeckSize(t *testing.T) {
+	bolt := uuid.New()
+	cards := []models.DeckCard{
+		{OracleID: bolt, Zone: models.ZoneMain, Quantity: 4},
+		{OracleID: bolt, Zone: models.ZoneCommander, Quantity: 1},
+	}
+	info := map[uuid.UUID]CardInfo{
+		bolt: {Name: "Lightning Bolt", TypeLine: "Instant", Status: "legal"},
+	}
+
+	legality := Validate(Formats["modern"], cards, info)
+
+	if len(legality.Deck) != 2 || legality.Deck[0].Rule != RuleDeckSize || legality.Deck[1].Rule != RuleCommander {
+		t.Fatalf("Expected the deck to be too small and have a commander, got %+v", legality.Deck)
+	}
+}
+
+func TestValidateCommander(t *testing.T) {
+	niv := uuid.New()
+	bolt := uuid.New()
+	swords := uuid.New()
+	island := uuid.New()
+	bear := uuid.New()
+
+	cards := []models.DeckCard{
+		{OracleID: niv, Zone: models.ZoneCommander, Quantity: 1},
+		{OracleID: bolt, Zone: models.ZoneMain, Quantity: 1},
+		{OracleID: swords, Zone: models.ZoneMain, Quantity: 1},
+		{OracleID: island, Zone: models.ZoneMain, Quantity: 96},
+		{OracleID: bear, Zone: models.ZoneMain, Quantity: 2},
+	}
+	info := map[uuid.UUID]CardInfo{
+		niv: {Name: "Niv-Mizzet, Parun", TypeLine: "Legendary Creature — Dragon Wizard", ColorIdentity: []string{"U", "R"}, Status: "legal"},
+		bolt: {Name: "Lightning Bolt", TypeLine: "Instant", ColorIdentity: []string{"R"}, Status: "legal"},
+		swords: {Name: "Swords to Plowshares", TypeLine: "Instant", ColorIdentity: []string{"W"}, Status: "legal"},
+		island: {Name: "Island", TypeLine: "Basic Land — Island", ColorIdentity: []string{"U"}, Status: "legal"},
+		bear: {Name: "Grizzly Bears", TypeLine: "Creature — Bear", ColorIdentity: []string{"G"}, Status: "legal"},
+	}
+
+	legality := Validate(Formats["commander"], cards, info)
+
+	if len(legality.Deck) != 1 || legality.Deck[0].Rule != RuleDeckSize {
+		t.Fatalf("Expected 101 cards to be too many, got %+v", legality.Deck)
+	}
+	if cardViolations(legality, bolt) != nil || cardViolations(legality, island) != nil {
+		t.Fatalf("Expected Lightning Bolt and the Islands to be fine, got %+v", legality.Cards)
+	}
+	violations := cardViolations(legality, swords)
+	if len(violations) != 1 || violations[0].Rule != RuleColorIdentity {
+		t.Fatalf("Expected Swords to Plowshares to be outside the color identity, got %+v", violations)
+	}
+	violations = cardViolations(legality, bear)
+	if len(violations) != 2 || violations[0].Rule != RuleCopies || violations[1].Rule != RuleColorIdentity {
+		t.Fatalf("Expected Grizzly Bears to break singleton and the color identity, got %+v", violations)
+	}
+}
+
+func TestValidateCommanderPartners(t *testing.T) {
+	thrasios := uuid.New()
+	tymna := uuid.New()
+	bear := uuid.New()
+
+	cards := []models.DeckCard{
+		{OracleID: thrasios, Zone: models.ZoneCommander, Quantity: 1},
+		{OracleID: tymna, Zone: models.ZoneCommander, Quantity: 1},
+		{OracleID: bear, Zone: models.ZoneCommander, Quantity: 1},
+	}
+	info := map[uuid.UUID]CardInfo{
+		thrasios: {Name: "Thrasios, Triton Hero", TypeLine: "Legendary Creature — Merfolk Wizard", OracleText: "Partner", Status: "legal"},
+		tymna: {Name: "Tymna the Weaver", TypeLine: "Legendary Creature — Human Cleric", OracleText: "Partner", Status: "legal"},
+		bear: {Name: "Grizzly Bears", TypeLine: "Creature — Bear", Status: "legal"},
+	}
+
+	legality := Validate(Formats["commander"], cards, info)
+
+	found := false
+	for _, violation := range legality.Deck {
+		found = found || violation.Rule == RuleCommander
+	}
+	if !found {
+		t.Fatalf("Expected three commanders to be too many, got %+v", legality.Deck)
+	}
+	violations := cardViolations(legality, bear)
+	if len(violations) != 1 || violations[0].Rule != RuleCommander {
+		t.Fatalf("Expected Grizzly Bears not to be a commander, got %+v", violations)
+	}
+
+	legality = Validate(Formats["commander"], cards[:2], info)
+	for _, violation := range legality.Deck {
+		if violation.Rule == RuleCommander {
+			t.Fatalf("Expected partners to share the command zone, got %+v", violation)
+		}
+	}
+}
@@ -3,23 +3,70 @@ package models
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/cardname"
 	"github.com/toxicglados/umori-go/pkg/crypto"
 	"github.com/toxicglados/umori-go/pkg/jsonurl"
 	"gorm.io/gorm"
 )
 
+const (
+	FinishNonfoil = "nonfoil"
+	FinishFoil = "foil"
+	FinishEtched = "etched"
+
+	CurrencyUSD = "usd"
+	CurrencyEUR = "eur"
+	CurrencyTix = "tix"
+
+	DirectionAbove = "above"
+	DirectionBelow = "below"
+
+	ConditionNearMint = "near_mint"
+	ConditionLightlyPlayed = "lightly_played"
+	ConditionModeratelyPlayed = "moderately_played"
+	ConditionHeavilyPlayed = "heavily_played"
+	ConditionDamaged = "damaged"
+
+	ChangeSourceManual = "manual"
+	ChangeSourceImport = "import"
+	ChangeSourceRevert = "revert"
+	ChangeSourceMove = "move"
+	ChangeSourceTrade = "trade"
+
+	TradeGive = "give"
+	TradeReceive = "receive"
+
+	ZoneMain = "main"
+	ZoneSide = "side"
+	ZoneMaybe = "maybe"
+	ZoneCommander = "commander"
+)
+
 var (
 	ErrMissingUsername error = errors.New("Username missing")
 	ErrMissingPassword error = errors.New("Password missing")
+	ErrUnmatchedBrace error = errors.New("Error parsing mana cost, unmatched {")
+	ErrMissingBrace error = errors.New("Error parsing mana cost, symbol missing {")
 )
 
 type Face struct {
 	gorm.Model `json:"-"`
 	Name string `json:"name"`
 	ImageURIs ImageURIs `json:"image_uris" gorm:"embedded"`
+	ManaCost string `json:"mana_cost"`
+	ManaSymbols []string `json:"mana_symbols" gorm:"type:jsonb;serializer:json"`
+	TypeLine string `json:"type_line"`
+	OracleText string `json:"oracle_text"`
+	Power string `json:"power"`
+	Toughness string `json:"toughness"`
+	Colors []string `json:"colors" gorm:"type:jsonb;serializer:json"`
+	// Only set for reversible cards, which can have
+	// a different oracle card on each face
+	OracleID uuid.UUID `json:"oracle_id"`
 	CardID uuid.UUID `json:"-"`
 }
 
@@ -30,18 +77,70 @@ type Finish struct {
 	CardID uuid.UUID `json:"-"`
 }
 
+// Legalities marshal as a map of format to status,
+// the same shape scryfall gives them to us in
+type Legalities []Legality
+type Legality struct {
+	gorm.Model `json:"-"`
+	CardID uuid.UUID `json:"-" gorm:"uniqueIndex:idx_card_format"`
+	Format string `json:"format" gorm:"uniqueIndex:idx_card_format"`
+	Status string `json:"status"`
+}
+
+// Prices are nil when scryfall doesn't know the price,
+// for example foil prices of cards with no foil printing
+type Prices struct {
+	USD *float64 `json:"usd"`
+	USDFoil *float64 `json:"usd_foil"`
+	USDEtched *float64 `json:"usd_etched"`
+	EUR *float64 `json:"eur"`
+	EURFoil *float64 `json:"eur_foil"`
+	Tix *float64 `json:"tix"`
+}
+
+// Scryfall gives us prices as strings
+type ScryfallPrices struct {
+	USD *string `json:"usd"`
+	USDFoil *string `json:"usd_foil"`
+	USDEtched *string `json:"usd_etched"`
+	EUR *string `json:"eur"`
+	EURFoil *string `json:"eur_foil"`
+	Tix *string `json:"tix"`
+}
+
 type ReleaseDate struct {
 	time.Time `gorm:"column:release_date"`
 }
 
+// Sets give their release date the way scryfall does rather than
+// as a full timestamp like cards, which have always done so
+type SetReleaseDate ReleaseDate
+
+// An OracleCard is a card in the abstract, ignoring which
+// set it's from or what it looks like. Every printing of
+// Lightning Bolt belongs to the same OracleCard.
+type OracleCard struct {
+	gorm.Model `json:"-"`
+	ID uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	Name string `json:"name"`
+	Layout string `json:"layout"`
+}
+
+// A Card is a single printing of an OracleCard
 type Card struct {
 	gorm.Model `json:"-"`
 	ID uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	OracleID uuid.UUID `json:"oracle_id" gorm:"type:uuid;index"`
 	Name string `json:"name"`
+	// Name as given by cardname.Normalize, it's what we
+	// match against for autocomplete
+	SearchName string `json:"-"`
 	URI jsonurl.JSONURL `json:"uri" gorm:"embedded"`
 	ImageURIs ImageURIs `json:"image_uris" gorm:"embedded"`
 	Faces []Face `json:"faces"`
 	Finishes Finishes `json:"finishes"`
+	// Formats the card isn't legal in are left out
+	Legalities Legalities `json:"legalities"`
 	DefaultLang bool `json:"default_lang"`
 	SetID uuid.UUID  `json:"-"`
 	Set Set `json:"set"`
@@ -50,6 +149,166 @@ type Card struct {
 	ReleaseDate ReleaseDate `json:"released_at" gorm:"embedded"`
 	Language string `json:"lang"`
 	DigitalExclusive bool `json:"digital_exclusive"`
+	// Multi-faced cards other than split cards leave
+	// these empty and have them on their faces instead
+	ManaCost string `json:"mana_cost"`
+	ManaSymbols []string `json:"mana_symbols" gorm:"type:jsonb;serializer:json"`
+	OracleText string `json:"oracle_text"`
+	Power string `json:"power"`
+	Toughness string `json:"toughness"`
+	TypeLine string `json:"type_line"`
+	CMC float64 `json:"cmc"`
+	Colors []string `json:"colors" gorm:"type:jsonb;serializer:json"`
+	// Colors in the mana cost and rules text, which is
+	// what decides which commander decks it can go in
+	ColorIdentity []string `json:"color_identity" gorm:"type:jsonb;serializer:json"`
+	Prices Prices `json:"prices" gorm:"embedded;embeddedPrefix:price_"`
+}
+
+// A PriceSnapshot is what a card's prices were on the day the importer
+// ran, keeping them lets us see how prices change over time
+type PriceSnapshot struct {
+	gorm.Model `json:"-"`
+	CardID uuid.UUID `json:"-" gorm:"uniqueIndex:idx_card_date"`
+	Date time.Time `json:"date" gorm:"type:date;uniqueIndex:idx_card_date"`
+	Prices Prices `json:"prices" gorm:"embedded;embeddedPrefix:price_"`
+}
+
+// An AlertRule asks us to notify a user when the price of a card
+// crosses Threshold, or changes by PercentChange between imports.
+// It's for either a single printing (CardID) or the cheapest
+// printing of an oracle card (OracleID), never both.
+type AlertRule struct {
+	gorm.Model `json:"-"`
+	ID uint `json:"id" gorm:"primarykey"`
+	UserID uint `json:"-" gorm:"index"`
+	CardID *uuid.UUID `json:"card_id" gorm:"type:uuid"`
+	OracleID *uuid.UUID `json:"oracle_id" gorm:"type:uuid"`
+	Finish string `json:"finish" gorm:"not null;default:nonfoil"`
+	Currency string `json:"currency" gorm:"not null;default:usd"`
+	// DirectionAbove or DirectionBelow
+	Direction string `json:"direction"`
+	Threshold *float64 `json:"threshold"`
+	PercentChange *float64 `json:"percent_change"`
+}
+
+// A WishlistItem is a card a user wants. Like an AlertRule it's
+// for either a single printing (CardID) or any printing of an
+// oracle card (OracleID), never both.
+type WishlistItem struct {
+	gorm.Model `json:"-"`
+	ID uint `json:"id" gorm:"primarykey"`
+	UserID uint `json:"-" gorm:"index"`
+	CardID *uuid.UUID `json:"card_id" gorm:"type:uuid"`
+	OracleID *uuid.UUID `json:"oracle_id" gorm:"type:uuid"`
+	Quantity int `json:"quantity" gorm:"not null;default:1"`
+	// Empty when any finish will do
+	Finish string `json:"finish"`
+	Currency string `json:"currency" gorm:"not null;default:usd"`
+	// The most they'd pay for a copy, nil when they don't mind
+	MaxPrice *float64 `json:"max_price"`
+}
+
+// TradeSettings are whether a user can be matched with others to
+// trade, and how many copies of each printing they want to keep
+type TradeSettings struct {
+	gorm.Model `json:"-"`
+	UserID uint `json:"-" gorm:"uniqueIndex"`
+	OptIn bool `json:"opt_in"`
+	// 0 means only what's tagged for-trade is up for trade
+	Keep int `json:"keep"`
+}
+
+// TradeProposal is one user offering some of their collection
+// for some of another's. Counters are new proposals going back
+// the other way, pointing at the proposal they replaced.
+type TradeProposal struct {
+	gorm.Model `json:"-"`
+	ID uint `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ProposerID uint `json:"-" gorm:"index"`
+	RecipientID uint `json:"-" gorm:"index"`
+	Proposer string `json:"proposer" gorm:"-"`
+	Recipient string `json:"recipient" gorm:"-"`
+	// One of the trades.State constants
+	State string `json:"state" gorm:"not null;default:pending"`
+	Message string `json:"message"`
+	CounterOfID *uint `json:"counter_of_id"`
+	// The batch of collection changes made when it was accepted
+	BatchID *uuid.UUID `json:"batch_id" gorm:"type:uuid"`
+	Items []TradeItem `json:"items" gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// TradeItem is copies of one of the collection entries in a trade
+type TradeItem struct {
+	gorm.Model `json:"-"`
+	TradeProposalID uint `json:"-" gorm:"index"`
+	// TradeGive when the proposer gives it away, TradeReceive when they get it
+	Direction string `json:"direction"`
+	CardID uuid.UUID `json:"card_id" gorm:"type:uuid"`
+	Finish string `json:"finish"`
+	Condition string `json:"condition"`
+	// Where the giver has it, it arrives without a location
+	LocationID uint `json:"location_id"`
+	Quantity int `json:"quantity"`
+}
+
+// A Deck is a list of cards a user wants to play, split into zones
+type Deck struct {
+	gorm.Model `json:"-"`
+	ID uint `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserID uint `json:"-" gorm:"uniqueIndex:idx_user_deck"`
+	Name string `json:"name" gorm:"uniqueIndex:idx_user_deck"`
+	// The format it's meant for, if it's meant for one
+	Format string `json:"format"`
+	Cards []DeckCard `json:"cards,omitempty" gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// DeckCard is copies of a card in one of a deck's zones. Decks
+// are about oracle cards, any printing will do to play one.
+type DeckCard struct {
+	gorm.Model `json:"-"`
+	DeckID uint `json:"-" gorm:"uniqueIndex:idx_deck_card"`
+	OracleID uuid.UUID `json:"oracle_id" gorm:"type:uuid;uniqueIndex:idx_deck_card"`
+	// Filled in from the oracle card when the deck is loaded
+	Name string `json:"name" gorm:"->;-:migration"`
+	// One of the Zone constants
+	Zone string `json:"zone" gorm:"uniqueIndex:idx_deck_card"`
+	Quantity int `json:"quantity"`
+}
+
+// DeckAllocation claims copies in a collection entry for a deck, so
+// it's clear which copies are in which deck. Nothing stops two decks
+// claiming the same copies, that's reported as over-allocated instead.
+type DeckAllocation struct {
+	gorm.Model `json:"-"`
+	ID uint `json:"id" gorm:"primarykey"`
+	UserID uint `json:"-" gorm:"index"`
+	DeckID uint `json:"deck_id" gorm:"uniqueIndex:idx_deck_allocation"`
+	Deck Deck `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	CollectionEntryID uint `json:"-" gorm:"uniqueIndex:idx_deck_allocation"`
+	// Moves and trades give up or move claims on the copies they
+	// take themselves, this is for copies that are removed outright
+	CollectionEntry CollectionEntry `json:"entry" gorm:"constraint:OnDelete:CASCADE"`
+	Quantity int `json:"quantity"`
+}
+
+type Notification struct {
+	gorm.Model `json:"-"`
+	ID uint `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID uint `json:"-" gorm:"index"`
+	AlertRuleID uint `json:"alert_rule_id" gorm:"uniqueIndex:idx_notification_rule_date"`
+	// The day of the prices that fired it, a rule only fires once a day
+	Date time.Time `json:"date" gorm:"type:date;uniqueIndex:idx_notification_rule_date"`
+	CardID uuid.UUID `json:"card_id"`
+	Message string `json:"message"`
+	Price float64 `json:"price"`
+	PreviousPrice *float64 `json:"previous_price"`
+	Read bool `json:"read"`
 }
 
 type Set struct {
@@ -58,6 +317,9 @@ type Set struct {
 	Name string `json:"name"`
 	Type string `json:"type"`
 	Code string `json:"code" gorm:"unique"` // The (usually) 3 letter code
+	// Scryfall doesn't tell us when a set was released in the card
+	// data, so this is the release date of the earliest card in the set
+	ReleaseDate SetReleaseDate `json:"released_at" gorm:"embedded"`
 }
 
 type ImageURIs struct {
@@ -83,6 +345,7 @@ type UnsafeUser struct {
 
 type ScryfallCard struct {
 	ID uuid.UUID `json:"id"`
+	OracleID uuid.UUID `json:"oracle_id"`
 	Name string `json:"name"`
 	URI jsonurl.JSONURL `json:"uri"`
 	ImageURIs ImageURIs `json:"image_uris"`
@@ -97,13 +360,73 @@ type ScryfallCard struct {
 	ReleaseDate ReleaseDate `json:"released_at"`
 	Language string `json:"lang"`
 	Digital bool `json:"digital"`
+	ManaCost string `json:"mana_cost"`
+	OracleText string `json:"oracle_text"`
+	Power string `json:"power"`
+	Toughness string `json:"toughness"`
+	TypeLine string `json:"type_line"`
+	CMC float64 `json:"cmc"`
+	Colors []string `json:"colors"`
+	ColorIdentity []string `json:"color_identity"`
+	Legalities map[string]string `json:"legalities"`
+	Prices ScryfallPrices `json:"prices"`
 }
 
 type CollectionEntry struct {
 	gorm.Model `json:"-"`
-	UserID uint `json:"-" gorm:"uniqueIndex:idx_user_card"`
-	CardID uuid.UUID `json:"card_id" gorm:"uniqueIndex:idx_user_card"`
+	UserID uint `json:"-" gorm:"uniqueIndex:idx_collection_entry_location"`
+	CardID uuid.UUID `json:"card_id" gorm:"uniqueIndex:idx_collection_entry_location"`
+	// One of the card's finishes, "nonfoil", "foil" or "etched"
+	Finish string `json:"finish" gorm:"uniqueIndex:idx_collection_entry_location;not null;default:nonfoil"`
+	// One of the Condition constants
+	Condition string `json:"condition" gorm:"uniqueIndex:idx_collection_entry_location;not null;default:near_mint"`
+	// Where the copies are kept, 0 when they haven't been put anywhere.
+	// Copies of a card can be split across entries in different locations.
+	LocationID uint `json:"location_id" gorm:"uniqueIndex:idx_collection_entry_location;not null;default:0"`
 	Quantity int `json:"quantity"`
+	// Goes up by one every time the entry changes, it's sent as the ETag
+	Version int `json:"version" gorm:"not null;default:1"`
+}
+
+// An EntryTag is a free-form label on a collection entry, like
+// "for-trade" or "cube". They go when the entry does.
+type EntryTag struct {
+	gorm.Model `json:"-"`
+	UserID uint `json:"-" gorm:"index:idx_user_tag"`
+	CollectionEntryID uint `json:"-" gorm:"uniqueIndex:idx_entry_tag"`
+	CollectionEntry CollectionEntry `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	// Always lowercase
+	Name string `json:"name" gorm:"uniqueIndex:idx_entry_tag;index:idx_user_tag"`
+}
+
+// A Location is somewhere a user keeps cards, like a binder or a box
+type Location struct {
+	gorm.Model `json:"-"`
+	ID uint `json:"id" gorm:"primarykey"`
+	UserID uint `json:"-" gorm:"uniqueIndex:idx_user_location"`
+	Name string `json:"name" gorm:"uniqueIndex:idx_user_location"`
+}
+
+// A CollectionChange records a change to the quantity of a collection
+// entry. They're never updated or deleted, undoing one adds another.
+type CollectionChange struct {
+	gorm.Model `json:"-"`
+	ID uint `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID uint `json:"-" gorm:"index"`
+	// Who made the change, the other user for accepted trades
+	ActorID uint `json:"actor_id"`
+	CardID uuid.UUID `json:"card_id" gorm:"type:uuid"`
+	Finish string `json:"finish"`
+	Condition string `json:"condition"`
+	LocationID uint `json:"location_id"`
+	Delta int `json:"delta"`
+	// One of the ChangeSource constants
+	Source string `json:"source"`
+	// Shared by every change from the same import or batch update
+	BatchID *uuid.UUID `json:"batch_id" gorm:"type:uuid;index"`
+	// The change this one undid
+	RevertsID *uint `json:"reverts_id" gorm:"index"`
 }
 
 func(user *User) UnmarshalJSON(data []byte) error {
@@ -132,6 +455,74 @@ func(user *User) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+func IsFinish(name string) bool {
+	return name == FinishNonfoil || name == FinishFoil || name == FinishEtched
+}
+
+func IsCondition(name string) bool {
+	switch name {
+	case ConditionNearMint, ConditionLightlyPlayed, ConditionModeratelyPlayed, ConditionHeavilyPlayed, ConditionDamaged:
+		return true
+	}
+	return false
+}
+
+func IsZone(name string) bool {
+	return name == ZoneMain || name == ZoneSide || name == ZoneMaybe || name == ZoneCommander
+}
+
+func IsCurrency(name string) bool {
+	return name == CurrencyUSD || name == CurrencyEUR || name == CurrencyTix
+}
+
+// The column a price for currency and finish is stored in on
+// anything with Prices embedded, e.g. price_usd_foil
+func PriceColumn(currency, finish string) string {
+	switch currency {
+	case CurrencyUSD:
+		if finish == FinishFoil {
+			return "price_usd_foil"
+		} else if finish == FinishEtched {
+			return "price_usd_etched"
+		}
+		return "price_usd"
+	case CurrencyEUR:
+		// Cardmarket doesn't tell etched foils apart from other foils
+		if finish == FinishNonfoil {
+			return "price_eur"
+		}
+		return "price_eur_foil"
+	}
+
+	return "price_tix"
+}
+
+// The price for currency and finish, the one PriceColumn says it's stored in
+func(prices Prices) Get(currency, finish string) *float64 {
+	switch PriceColumn(currency, finish) {
+	case "price_usd_foil":
+		return prices.USDFoil
+	case "price_usd_etched":
+		return prices.USDEtched
+	case "price_usd":
+		return prices.USD
+	case "price_eur_foil":
+		return prices.EURFoil
+	case "price_eur":
+		return prices.EUR
+	}
+	return prices.Tix
+}
+
+func(finishes Finishes) Has(name string) bool {
+	for _, finish := range finishes {
+		if finish.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func(finishes Finishes) MarshalJSON() ([]byte, error) {
 	var stringFinishes []string
 	for _, finish := range finishes {
@@ -141,6 +532,58 @@ func(finishes Finishes) MarshalJSON() ([]byte, error) {
 	return json.Marshal(stringFinishes)
 }
 
+func(legalities Legalities) MarshalJSON() ([]byte, error) {
+	mapLegalities := make(map[string]string)
+	for _, legality := range legalities {
+		mapLegalities[legality.Format] = legality.Status
+	}
+
+	return json.Marshal(mapLegalities)
+}
+
+func(prices Prices) IsEmpty() bool {
+	return prices.USD == nil && prices.USDFoil == nil && prices.USDEtched == nil &&
+	       prices.EUR == nil && prices.EURFoil == nil && prices.Tix == nil
+}
+
+func parsePrice(price *string) (*float64, error) {
+	if price == nil {
+		return nil, nil
+	}
+
+	parsed, err := strconv.ParseFloat(*price, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsed, nil
+}
+
+func(scryfallPrices ScryfallPrices) Parse() (Prices, error) {
+	var prices Prices
+	var err error
+
+	fields := []struct {
+		from *string
+		to **float64
+	}{
+		{scryfallPrices.USD, &prices.USD},
+		{scryfallPrices.USDFoil, &prices.USDFoil},
+		{scryfallPrices.USDEtched, &prices.USDEtched},
+		{scryfallPrices.EUR, &prices.EUR},
+		{scryfallPrices.EURFoil, &prices.EURFoil},
+		{scryfallPrices.Tix, &prices.Tix},
+	}
+	for _, field := range fields {
+		*field.to, err = parsePrice(field.from)
+		if err != nil {
+			return prices, err
+		}
+	}
+
+	return prices, nil
+}
+
 func(date *ReleaseDate) UnmarshalJSON(data []byte) error {
 	t, err := time.Parse(time.DateOnly, string(data[1:len(data)-1]))
 	if err != nil {
@@ -151,6 +594,46 @@ func(date *ReleaseDate) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Marshal back to the same format scryfall gives us
+// so the JSON we return can be read by UnmarshalJSON
+func(date SetReleaseDate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(date.Format(time.DateOnly))
+}
+
+func(date *SetReleaseDate) UnmarshalJSON(data []byte) error {
+	return (*ReleaseDate)(date).UnmarshalJSON(data)
+}
+
+// Splits a mana cost like "{2}{W/U}" into its symbols. Split cards
+// have costs like "{R} // {U}{U}" so we skip the separator between halves
+func SplitManaCost(manaCost string) ([]string, error){
+	manaSymbols := []string{}
+	var symbolAccumulator string = ""
+
+	for _, c := range manaCost {
+		char := string(c)
+		if symbolAccumulator == "" && char != "{" {
+			if char == " " || char == "/" {
+				continue
+			}
+			return nil, ErrMissingBrace
+		}
+
+		symbolAccumulator = symbolAccumulator + char
+		if char == "}" {
+			manaSymbols = append(manaSymbols, string(symbolAccumulator))
+			symbolAccumulator = ""
+		}
+	}
+
+	// TODO: Consider validating the mana symbol against a list of known ones
+	if symbolAccumulator != "" {
+		return nil, ErrUnmatchedBrace
+	}
+
+	return manaSymbols, nil
+}
+
 func(card *Card) UnmarshalJSON(data []byte) error {
 	var jsonCard ScryfallCard
 	err := json.Unmarshal(data, &jsonCard)
@@ -158,21 +641,89 @@ func(card *Card) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
+	manaSymbols, err := SplitManaCost(jsonCard.ManaCost)
+	if err != nil {
+		return err
+	}
+
+	prices, err := jsonCard.Prices.Parse()
+	if err != nil {
+		return err
+	}
+
+	// Cards with faces only have colors on the faces
+	// so we combine them to get the colors of the card
+	colors := jsonCard.Colors
+	if colors == nil {
+		colors = []string{}
+		seen := make(map[string]bool)
+		for _, face := range jsonCard.Faces {
+			for _, color := range face.Colors {
+				if !seen[color] {
+					seen[color] = true
+					colors = append(colors, color)
+				}
+			}
+		}
+	}
+
+	colorIdentity := jsonCard.ColorIdentity
+	if colorIdentity == nil {
+		colorIdentity = []string{}
+	}
+
+	for i := range jsonCard.Faces {
+		jsonCard.Faces[i].ManaSymbols, err = SplitManaCost(jsonCard.Faces[i].ManaCost)
+		if err != nil {
+			return err
+		}
+		if jsonCard.Faces[i].Colors == nil {
+			jsonCard.Faces[i].Colors = []string{}
+		}
+	}
+
 	var finishes []Finish
 	for _, finish := range jsonCard.Finishes {
 		finishes = append(finishes, Finish{Name: finish})
 	}
 
+	// Nearly every card is not_legal in nearly every format,
+	// leaving those out saves us millions of rows
+	var legalities []Legality
+	for format, status := range jsonCard.Legalities {
+		if status != "not_legal" {
+			legalities = append(legalities, Legality{Format: format, Status: status})
+		}
+	}
+
 	card.ID = jsonCard.ID
+	card.OracleID = jsonCard.OracleID
+	// Reversible cards don't have an oracle_id of their own,
+	// the front face is the closest thing to one
+	if card.OracleID == uuid.Nil && len(jsonCard.Faces) > 0 {
+		card.OracleID = jsonCard.Faces[0].OracleID
+	}
 	card.Name = jsonCard.Name
+	card.SearchName = cardname.Normalize(jsonCard.Name)
 	card.URI = jsonCard.URI
 	card.CollectorNumber = jsonCard.CollectorNumber
 	card.Faces = jsonCard.Faces
 	card.Layout = jsonCard.Layout
 	card.Finishes = finishes
+	card.Legalities = legalities
 	card.Language = jsonCard.Language
 	card.ReleaseDate = jsonCard.ReleaseDate
 	card.DigitalExclusive = jsonCard.Digital
+	card.ManaCost = jsonCard.ManaCost
+	card.ManaSymbols = manaSymbols
+	card.OracleText = jsonCard.OracleText
+	card.Power = jsonCard.Power
+	card.Toughness = jsonCard.Toughness
+	card.TypeLine = jsonCard.TypeLine
+	card.CMC = jsonCard.CMC
+	card.Colors = colors
+	card.ColorIdentity = colorIdentity
+	card.Prices = prices
 	card.ImageURIs = ImageURIs{
 		Small: jsonCard.ImageURIs.Small,
 		Normal: jsonCard.ImageURIs.Normal,
@@ -186,6 +737,7 @@ func(card *Card) UnmarshalJSON(data []byte) error {
 		Name: jsonCard.SetName,
 		Type: jsonCard.SetType,
 		Code: jsonCard.SetCode,
+		ReleaseDate: SetReleaseDate(jsonCard.ReleaseDate),
 	}
 
 	return nil
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSplitManaCost(t *testing.T) {
+	tests := map[string][]string{
+		"": {},
+		"{2}{W/U}{W/U}": {"{2}", "{W/U}", "{W/U}"},
+		"{R} // {U}{U}": {"{R}", "{U}", "{U}"},
+	}
+
+	for manaCost, expected := range tests {
+		symbols, err := SplitManaCost(manaCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(symbols, expected) {
+			t.Fatalf("Expected \"%s\" to split into %v, got %v", manaCost, expected, symbols)
+		}
+	}
+
+	_, err := SplitManaCost("{2}{U")
+	if err != ErrUnmatchedBrace {
+		t.Fatalf("Expected ErrUnmatchedBrace, got %v", err)
+	}
+
+	_, err = SplitManaCost("2}")
+	if err != ErrMissingBrace {
+		t.Fatalf("Expected ErrMissingBrace, got %v", err)
+	}
+}
+
+func TestUnmarshalMultiFacedCard(t *testing.T) {
+	data := `{
+		"id": "e0fed1e5-fcbd-4597-91b5-ba809571573b",
+		"name": "Delver of Secrets // Insectile Aberration",
+		"released_at": "2011-09-30",
+		"type_line": "Creature — Human Wizard // Creature — Human Insect",
+		"cmc": 1.0,
+		"color_identity": ["U"],
+		"card_faces": [
+			{"name": "Delver of Secrets", "mana_cost": "{U}", "colors": ["U"], "power": "1", "toughness": "1"},
+			{"name": "Insectile Aberration", "mana_cost": "", "colors": ["U"], "power": "3", "toughness": "2"}
+		]
+	}`
+
+	var card Card
+	err := json.Unmarshal([]byte(data), &card)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(card.Colors, []string{"U"}) {
+		t.Fatalf("Expected card colors to come from its faces, got %v", card.Colors)
+	}
+	if !reflect.DeepEqual(card.Faces[0].ManaSymbols, []string{"{U}"}) {
+		t.Fatalf("Expected front face to have mana symbols [{U}], got %v", card.Faces[0].ManaSymbols)
+	}
+	if card.CMC != 1 || card.Faces[1].Power != "3" || !reflect.DeepEqual(card.ColorIdentity, []string{"U"}) {
+		t.Fatal("Gameplay data wasn't imported")
+	}
+}
+
+func TestMarshalReleaseDate(t *testing.T) {
+	var card Card
+	err := json.Unmarshal([]byte(`{"id": "e0fed1e5-fcbd-4597-91b5-ba809571573b", "released_at": "2011-09-30", "set": "isd"}`), &card)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dates struct {
+		ReleasedAt string `json:"released_at"`
+		Set struct {
+			ReleasedAt string `json:"released_at"`
+		} `json:"set"`
+	}
+	err = json.Unmarshal(data, &dates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cards have always given a full timestamp, only sets use scryfall's format
+	if dates.ReleasedAt != "2011-09-30T00:00:00Z" {
+		t.Fatalf("Expected card released_at to be unchanged, got %s", dates.ReleasedAt)
+	}
+	if dates.Set.ReleasedAt != "2011-09-30" {
+		t.Fatalf("Expected set released_at to be 2011-09-30, got %s", dates.Set.ReleasedAt)
+	}
+}
@@ -0,0 +1,335 @@
+package resolver
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/toxicglados/umori-go/pkg/cardname"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type MatchType string
+type Status string
+
+const (
+	// Matched on set code and collector number
+	MatchPrinting MatchType = "printing"
+	MatchExact MatchType = "exact"
+	// Matched ignoring case and diacritics
+	MatchInsensitive MatchType = "insensitive"
+	MatchFuzzy MatchType = "fuzzy"
+
+	StatusResolved Status = "resolved"
+	StatusAmbiguous Status = "ambiguous"
+	StatusNotFound Status = "not_found"
+
+	// How many names to consider when fuzzy matching
+	fuzzyCandidates = 5
+)
+
+var (
+	// Matches lines like "Jace, the Mind Sculptor (WWK)" or "Jace, the Mind Sculptor (WWK) 31"
+	setSuffix = regexp.MustCompile(`^(.+?)\s*\(([A-Za-z0-9]+)\)(?:\s+(\S+))?$`)
+	likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+)
+
+// Query describes a card the way people tend to write them.
+// Only Name is required, the rest narrow down which printing we pick.
+type Query struct {
+	Name string `json:"name"`
+	SetCode string `json:"set"`
+	CollectorNumber string `json:"collector_number"`
+	Language string `json:"lang"`
+	// The loosest kind of name match allowed, defaults to MatchFuzzy
+	Loosest MatchType `json:"-"`
+}
+
+type Result struct {
+	Status Status `json:"status"`
+	Match MatchType `json:"match,omitempty"`
+	Card *models.Card `json:"card,omitempty"`
+	// Names that could have been meant when Status is StatusAmbiguous
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+type Resolver struct {
+	db *gorm.DB
+}
+
+func New(db *gorm.DB) *Resolver {
+	return &Resolver{db: db}
+}
+
+// ParseQuery splits a pasted name like "Jace, the Mind Sculptor (WWK) 31"
+// into its name, set code and collector number
+func ParseQuery(line string) Query {
+	line = strings.TrimSpace(line)
+	matches := setSuffix.FindStringSubmatch(line)
+	if matches == nil {
+		return Query{Name: line}
+	}
+
+	return Query{
+		Name: matches[1],
+		SetCode: strings.ToLower(matches[2]),
+		CollectorNumber: matches[3],
+	}
+}
+
+// Resolve finds the card query refers to. It tries progressively looser
+// matches and stops at the first one that finds anything.
+// Rather than guessing between several similar names we
+// return them as candidates with StatusAmbiguous.
+func (r *Resolver) Resolve(query Query) (Result, error) {
+	query.SetCode = strings.ToLower(query.SetCode)
+	query.Language = strings.ToLower(query.Language)
+	if query.Loosest == "" {
+		query.Loosest = MatchFuzzy
+	}
+
+	// The printing the set code and collector number point
+	// at when it turned out to be some other card than named
+	var mismatched *models.Card
+	if query.SetCode != "" && query.CollectorNumber != "" {
+		card, err := r.printing("", query)
+		if err != nil {
+			return Result{}, err
+		}
+		if card != nil && (strings.TrimSpace(query.Name) == "" || nameMatches(query.Name, card.Name)) {
+			return Result{Status: StatusResolved, Match: MatchPrinting, Card: card}, nil
+		}
+		mismatched = card
+	}
+
+	if strings.TrimSpace(query.Name) == "" {
+		return Result{Status: StatusNotFound}, nil
+	}
+
+	names, match, confident, err := r.names(query)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if mismatched != nil {
+		return mismatchResult(mismatched, names, match), nil
+	}
+
+	if len(names) == 0 {
+		return Result{Status: StatusNotFound}, nil
+	} else if len(names) > 1 || !confident {
+		return Result{Status: StatusAmbiguous, Match: match, Candidates: names}, nil
+	}
+
+	card, err := r.printing(names[0], query)
+	if err != nil {
+		return Result{}, err
+	}
+	if card == nil {
+		// The name exists, just not in the set they asked for
+		return Result{Status: StatusNotFound, Match: match, Candidates: names}, nil
+	}
+
+	return Result{Status: StatusResolved, Match: match, Card: card}, nil
+}
+
+// Decides between mismatched, the printing the set code and collector
+// number point at, and names, what the name on its own matched.
+func mismatchResult(mismatched *models.Card, names []string, match MatchType) Result {
+	// Just a misspelling of the printing's own name
+	if len(names) == 1 && names[0] == mismatched.Name {
+		return Result{Status: StatusResolved, Match: MatchPrinting, Card: mismatched}
+	}
+
+	// Either the name or the number is wrong and we can't
+	// tell which, so we offer both cards to choose from
+	candidates := names
+	if !slices.Contains(candidates, mismatched.Name) {
+		candidates = append(candidates, mismatched.Name)
+	}
+	return Result{Status: StatusAmbiguous, Match: match, Candidates: candidates}
+}
+
+// Says whether name, as someone wrote it, refers to the card
+// called cardName. It ignores case and diacritics and, for cards with
+// more than one face like "Fire // Ice", accepts the name of any face.
+func nameMatches(name string, cardName string) bool {
+	normalized := cardname.Normalize(name)
+	if normalized == cardname.Normalize(cardName) {
+		return true
+	}
+
+	for _, face := range strings.Split(cardName, " // ") {
+		if normalized == cardname.Normalize(face) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the card names query could refer to, along with how loosely
+// we had to match to find them and whether we're confident in a single
+// fuzzy match
+func (r *Resolver) names(query Query) ([]string, MatchType, bool, error) {
+	var names []string
+	err := r.db.Model(&models.Card{}).
+	            Distinct("name").
+	            Where("name = ?", query.Name).
+	            Pluck("name", &names).
+	            Error
+	if err != nil || len(names) > 0 {
+		return names, MatchExact, true, err
+	}
+
+	// Arena and a lot of decklists only name the front face
+	// of cards like "Bonecrusher Giant // Stomp"
+	err = r.db.Model(&models.Card{}).
+	           Distinct("name").
+	           Where("name LIKE ?", likeEscaper.Replace(query.Name) + " // %").
+	           Pluck("name", &names).
+	           Error
+	if err != nil || len(names) > 0 || query.Loosest == MatchExact {
+		return names, MatchExact, true, err
+	}
+
+	normalized := cardname.Normalize(query.Name)
+	err = r.db.Model(&models.Card{}).
+	           Distinct("name").
+	           Where("search_name = ? OR search_name LIKE ?", normalized, likeEscaper.Replace(normalized) + " // %").
+	           Pluck("name", &names).
+	           Error
+	if err != nil || len(names) > 0 || query.Loosest == MatchInsensitive {
+		return names, MatchInsensitive, true, err
+	}
+
+	// % is pg_trgm's similarity operator, the trigram index
+	// on search_name narrows things down and then we
+	// pick between what it finds using edit distance
+	err = r.db.Model(&models.Card{}).
+	           Select("name").
+	           Where("search_name % ?", normalized).
+	           Group("name").
+	           Clauses(clause.OrderBy{Expression: clause.Expr{
+	               SQL: "MAX(similarity(search_name, ?)) DESC",
+	               Vars: []interface{}{normalized},
+	               WithoutParentheses: true,
+	           }}).
+	           Limit(fuzzyCandidates).
+	           Pluck("name", &names).
+	           Error
+	if err != nil {
+		return nil, MatchFuzzy, false, err
+	}
+
+	closest, confident := closestName(normalized, names)
+	if !confident {
+		return names, MatchFuzzy, false, nil
+	}
+
+	return []string{closest}, MatchFuzzy, true, nil
+}
+
+// Finds the printing of name that best fits query. If name is
+// empty we look it up purely by set code and collector number.
+// Returns nil when there's no such printing.
+func (r *Resolver) printing(name string, query Query) (*models.Card, error) {
+	result := r.db.Model(&models.Card{}).
+	               Preload("Set").
+	               Preload("Finishes").
+	               Preload("Faces").
+	               Preload("Legalities")
+
+	if name != "" {
+		result = result.Where("cards.name = ?", name)
+	}
+	if query.SetCode != "" {
+		result = result.Joins("JOIN sets ON sets.id = cards.set_id").
+		                Where("sets.code = ?", query.SetCode)
+	}
+	if query.CollectorNumber != "" {
+		result = result.Where("cards.collector_number = ?", query.CollectorNumber)
+	}
+	if query.Language != "" {
+		result = result.Where("cards.language = ?", query.Language)
+	}
+
+	// Without anything else to go on we prefer the most
+	// recent paper printing in the default language
+	var cards []models.Card
+	err := result.Order("cards.digital_exclusive").
+	              Order("cards.default_lang desc").
+	              Order(`
+	              CASE
+	                WHEN cards.language = 'en' THEN 0
+	                ELSE 1
+	              END`).
+	              Order("cards.release_date desc").
+	              Limit(1).
+	              Find(&cards).
+	              Error
+	if err != nil || len(cards) == 0 {
+		return nil, err
+	}
+
+	return &cards[0], nil
+}
+
+// Picks the name closest to target by edit distance. If it isn't
+// clearly the closest, or isn't close at all, we aren't confident
+// in it and the caller should ask which one was meant.
+func closestName(target string, names []string) (string, bool) {
+	if len(names) == 0 {
+		return "", false
+	}
+
+	best := -1
+	bestDistance := -1
+	tied := false
+	for i, name := range names {
+		distance := Distance(target, cardname.Normalize(name))
+		if best == -1 || distance < bestDistance {
+			best = i
+			bestDistance = distance
+			tied = false
+		} else if distance == bestDistance {
+			tied = true
+		}
+	}
+
+	// Allow roughly one typo for every four letters
+	maxDistance := len([]rune(target)) / 4
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+
+	return names[best], !tied && bestDistance <= maxDistance
+}
+
+// Distance is the Levenshtein distance between a and b
+func Distance(a, b string) int {
+	source := []rune(a)
+	target := []rune(b)
+
+	// We only need the previous row of the matrix to compute the next
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(target)]
+}
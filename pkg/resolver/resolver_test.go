@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"testing"
+
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a string
+		b string
+		distance int
+	}{
+		{"mulldrifter", "mulldrifter", 0},
+		{"mulldrifer", "mulldrifter", 1},
+		{"", "bolt", 4},
+		{"jötun", "jotun", 1},
+		{"kitten", "sitting", 3},
+	}
+
+	for _, test := range tests {
+		distance := Distance(test.a, test.b)
+		if distance != test.distance {
+			t.Fatalf("Expected distance between \"%s\" and \"%s\" to be %d, got %d", test.a, test.b, test.distance, distance)
+		}
+	}
+}
+
+func TestClosestName(t *testing.T) {
+	name, confident := closestName("mulldrifer", []string{"Mulldrifter", "Mindrifter"})
+	if !confident || name != "Mulldrifter" {
+		t.Fatalf("Expected to confidently pick \"Mulldrifter\", got \"%s\" (confident: %t)", name, confident)
+	}
+
+	_, confident = closestName("bolt", []string{"Bola", "Boot"})
+	if confident {
+		t.Fatal("Expected tied names to not be confident")
+	}
+
+	_, confident = closestName("lightning", []string{"Lightning Bolt"})
+	if confident {
+		t.Fatal("Expected a distant name to not be confident")
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := map[string]Query{
+		"Mulldrifer": {Name: "Mulldrifer"},
+		"Jace, the Mind Sculptor (WWK)": {Name: "Jace, the Mind Sculptor", SetCode: "wwk"},
+		" Jace, the Mind Sculptor (WWK) 31 ": {Name: "Jace, the Mind Sculptor", SetCode: "wwk", CollectorNumber: "31"},
+	}
+
+	for line, expected := range tests {
+		query := ParseQuery(line)
+		if query != expected {
+			t.Fatalf("Expected \"%s\" to parse as %+v, got %+v", line, expected, query)
+		}
+	}
+}
+
+func TestNameMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		cardName string
+		matches bool
+	}{
+		{"Lightning Bolt", "Lightning Bolt", true},
+		{"lightning bolt", "Lightning Bolt", true},
+		{"Jotun Grunt", "Jötun Grunt", true},
+		{"Fire", "Fire // Ice", true},
+		{"Ice", "Fire // Ice", true},
+		{"Lightning Bolt", "Lava Axe", false},
+		{"Fire", "Fireball", false},
+	}
+
+	for _, test := range tests {
+		if nameMatches(test.name, test.cardName) != test.matches {
+			t.Fatalf("Expected \"%s\" matching \"%s\" to be %t", test.name, test.cardName, test.matches)
+		}
+	}
+}
+
+func TestMismatchResult(t *testing.T) {
+	bolt := &models.Card{Name: "Lightning Bolt"}
+
+	// "Lightnig Bolt (M10) 146" fuzzy matches the printing's own name
+	result := mismatchResult(bolt, []string{"Lightning Bolt"}, MatchFuzzy)
+	if result.Status != StatusResolved || result.Match != MatchPrinting || result.Card != bolt {
+		t.Fatalf("Expected the printing to be resolved, got %+v", result)
+	}
+
+	result = mismatchResult(bolt, []string{"Lava Axe"}, MatchExact)
+	if result.Status != StatusAmbiguous || len(result.Candidates) != 2 || result.Candidates[0] != "Lava Axe" || result.Candidates[1] != "Lightning Bolt" {
+		t.Fatalf("Expected both names as candidates, got %+v", result)
+	}
+
+	result = mismatchResult(bolt, []string{"Lightning Bolt", "Lightning Axe"}, MatchFuzzy)
+	if result.Status != StatusAmbiguous || len(result.Candidates) != 2 {
+		t.Fatalf("Expected the fuzzy matches as candidates, got %+v", result)
+	}
+}
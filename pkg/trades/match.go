@@ -0,0 +1,121 @@
+package trades
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+// Surplus is copies of a printing someone is willing to trade away
+type Surplus struct {
+	CardID uuid.UUID
+	OracleID uuid.UUID
+	Finish string
+	Quantity int
+	Prices models.Prices `gorm:"embedded;embeddedPrefix:price_"`
+}
+
+// Want is how many more copies of a wishlist item someone needs
+type Want struct {
+	Item models.WishlistItem
+	Quantity int
+}
+
+// Offer is copies of a printing that could change hands
+type Offer struct {
+	CardID uuid.UUID `json:"-"`
+	Card models.Card `json:"card"`
+	Finish string `json:"finish"`
+	Quantity int `json:"quantity"`
+	// Each, nil when we don't know it
+	Price *float64 `json:"price"`
+	Value float64 `json:"value"`
+}
+
+func (want Want) accepts(surplus Surplus) bool {
+	item := want.Item
+	if item.CardID != nil && *item.CardID != surplus.CardID {
+		return false
+	}
+	if item.OracleID != nil && *item.OracleID != surplus.OracleID {
+		return false
+	}
+	if item.Finish != "" && item.Finish != surplus.Finish {
+		return false
+	}
+	if item.MaxPrice != nil {
+		price := surplus.Prices.Get(item.Currency, surplus.Finish)
+		if price == nil || *price > *item.MaxPrice {
+			return false
+		}
+	}
+	return true
+}
+
+// Match works out which surplus copies would fill wants, valuing
+// them in currency. Each copy only fills one want. Wants for a
+// single printing go first since they're the pickiest, and
+// the cheapest copies that'll do are used first.
+func Match(surplus []Surplus, wants []Want, currency string) ([]Offer, float64) {
+	remaining := make([]int, len(surplus))
+	for i := range surplus {
+		remaining[i] = surplus[i].Quantity
+	}
+
+	ordered := make([]Want, len(wants))
+	copy(ordered, wants)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Item.CardID != nil && ordered[j].Item.CardID == nil
+	})
+
+	type offerKey struct {
+		CardID uuid.UUID
+		Finish string
+	}
+	var offers []Offer
+	index := make(map[offerKey]int)
+	for _, want := range ordered {
+		var candidates []int
+		for i := range surplus {
+			if remaining[i] > 0 && want.accepts(surplus[i]) {
+				candidates = append(candidates, i)
+			}
+		}
+		sort.SliceStable(candidates, func(a, b int) bool {
+			priceA := surplus[candidates[a]].Prices.Get(want.Item.Currency, surplus[candidates[a]].Finish)
+			priceB := surplus[candidates[b]].Prices.Get(want.Item.Currency, surplus[candidates[b]].Finish)
+			return priceA != nil && (priceB == nil || *priceA < *priceB)
+		})
+
+		needed := want.Quantity
+		for _, i := range candidates {
+			if needed == 0 {
+				break
+			}
+			quantity := min(needed, remaining[i])
+			remaining[i] -= quantity
+			needed -= quantity
+
+			key := offerKey{CardID: surplus[i].CardID, Finish: surplus[i].Finish}
+			if _, ok := index[key]; !ok {
+				index[key] = len(offers)
+				offers = append(offers, Offer{
+					CardID: surplus[i].CardID,
+					Finish: surplus[i].Finish,
+					Price: surplus[i].Prices.Get(currency, surplus[i].Finish),
+				})
+			}
+			offers[index[key]].Quantity += quantity
+		}
+	}
+
+	total := 0.0
+	for i := range offers {
+		if offers[i].Price != nil {
+			offers[i].Value = *offers[i].Price * float64(offers[i].Quantity)
+			total += offers[i].Value
+		}
+	}
+	return offers, total
+}
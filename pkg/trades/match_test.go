@@ -0,0 +1,63 @@
+package trades
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+func price(p float64) *float64 {
+	return &p
+}
+
+func TestMatch(t *testing.T) {
+	bolt := uuid.New()
+	boltM10 := uuid.New()
+	boltM11 := uuid.New()
+	mulldrifter := uuid.New()
+
+	surplus := []Surplus{
+		{CardID: boltM10, OracleID: bolt, Finish: models.FinishNonfoil, Quantity: 3, Prices: models.Prices{USD: price(2)}},
+		{CardID: boltM11, OracleID: bolt, Finish: models.FinishNonfoil, Quantity: 2, Prices: models.Prices{USD: price(1)}},
+		{CardID: mulldrifter, OracleID: uuid.New(), Finish: models.FinishFoil, Quantity: 1, Prices: models.Prices{USDFoil: price(10)}},
+	}
+	wants := []Want{
+		// Any Lightning Bolt, the cheap M11 ones go first
+		{Item: models.WishlistItem{OracleID: &bolt, Currency: models.CurrencyUSD}, Quantity: 3},
+		// Wants the M10 printing specifically so it's filled first
+		{Item: models.WishlistItem{CardID: &boltM10, Currency: models.CurrencyUSD}, Quantity: 1},
+		// Too expensive
+		{Item: models.WishlistItem{CardID: &mulldrifter, Currency: models.CurrencyUSD, MaxPrice: price(5)}, Quantity: 1},
+	}
+
+	offers, total := Match(surplus, wants, models.CurrencyUSD)
+
+	if len(offers) != 2 {
+		t.Fatalf("Expected 2 offers, got %+v", offers)
+	}
+	if offers[0].CardID != boltM10 || offers[0].Quantity != 2 {
+		t.Fatalf("Expected 2 M10 bolts, got %+v", offers[0])
+	}
+	if offers[1].CardID != boltM11 || offers[1].Quantity != 2 {
+		t.Fatalf("Expected 2 M11 bolts, got %+v", offers[1])
+	}
+	if total != 6 {
+		t.Fatalf("Expected a total of 6, got %f", total)
+	}
+}
+
+func TestMatchFinish(t *testing.T) {
+	card := uuid.New()
+	surplus := []Surplus{
+		{CardID: card, Finish: models.FinishNonfoil, Quantity: 4},
+	}
+	wants := []Want{
+		{Item: models.WishlistItem{CardID: &card, Finish: models.FinishFoil}, Quantity: 1},
+	}
+
+	offers, _ := Match(surplus, wants, models.CurrencyUSD)
+	if len(offers) != 0 {
+		t.Fatalf("Expected nonfoils not to fill a want for a foil, got %+v", offers)
+	}
+}
@@ -0,0 +1,71 @@
+package trades
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The states a proposal can be in. Everything but pending is final.
+const (
+	StatePending = "pending"
+	StateAccepted = "accepted"
+	StateDeclined = "declined"
+	// Replaced by a proposal going the other way
+	StateCountered = "countered"
+	StateCancelled = "cancelled"
+
+	ActionAccept = "accept"
+	ActionDecline = "decline"
+	ActionCounter = "counter"
+	ActionCancel = "cancel"
+)
+
+var (
+	ErrUnknownAction error = errors.New("Unknown action, expected accept, decline, counter or cancel")
+	ErrNotRecipient error = errors.New("Only the user a proposal was sent to can accept, decline or counter it")
+	ErrNotProposer error = errors.New("Only the user who made a proposal can cancel it")
+)
+
+// TransitionError is an action that can't be taken from a proposal's state
+type TransitionError struct {
+	State string
+	Action string
+}
+
+func (err TransitionError) Error() string {
+	return fmt.Sprintf("Can't %s a proposal that's %s", err.Action, err.State)
+}
+
+// The state each action moves a pending proposal to
+var transitions = map[string]string{
+	ActionAccept: StateAccepted,
+	ActionDecline: StateDeclined,
+	ActionCounter: StateCountered,
+	ActionCancel: StateCancelled,
+}
+
+// IsState says whether state is one of the proposal states
+func IsState(state string) bool {
+	return state == StatePending || state == StateAccepted || state == StateDeclined ||
+	       state == StateCountered || state == StateCancelled
+}
+
+// Transition works out which state action moves a proposal in state to.
+// proposer is whether the user taking the action made the proposal,
+// only they can cancel it and only the other user can do anything else.
+func Transition(state, action string, proposer bool) (string, error) {
+	next, ok := transitions[action]
+	if !ok {
+		return "", ErrUnknownAction
+	}
+	if state != StatePending {
+		return "", TransitionError{State: state, Action: action}
+	}
+	if action == ActionCancel && !proposer {
+		return "", ErrNotProposer
+	}
+	if action != ActionCancel && proposer {
+		return "", ErrNotRecipient
+	}
+	return next, nil
+}
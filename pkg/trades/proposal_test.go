@@ -0,0 +1,45 @@
+package trades
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTransition(t *testing.T) {
+	tests := []struct {
+		State string
+		Action string
+		Proposer bool
+		Next string
+		Err error
+	}{
+		{StatePending, ActionAccept, false, StateAccepted, nil},
+		{StatePending, ActionDecline, false, StateDeclined, nil},
+		{StatePending, ActionCounter, false, StateCountered, nil},
+		{StatePending, ActionCancel, true, StateCancelled, nil},
+		{StatePending, ActionAccept, true, "", ErrNotRecipient},
+		{StatePending, ActionCounter, true, "", ErrNotRecipient},
+		{StatePending, ActionCancel, false, "", ErrNotProposer},
+		{StatePending, "haggle", false, "", ErrUnknownAction},
+		{StateDeclined, ActionAccept, false, "", TransitionError{State: StateDeclined, Action: ActionAccept}},
+		{StateAccepted, ActionCancel, true, "", TransitionError{State: StateAccepted, Action: ActionCancel}},
+		{StateCountered, ActionCounter, false, "", TransitionError{State: StateCountered, Action: ActionCounter}},
+	}
+
+	for _, test := range tests {
+		next, err := Transition(test.State, test.Action, test.Proposer)
+		if !errors.Is(err, test.Err) {
+			t.Fatalf("%s from %s: expected error %v, got %v", test.Action, test.State, test.Err, err)
+		}
+		if next != test.Next {
+			t.Fatalf("%s from %s: expected %s, got %s", test.Action, test.State, test.Next, next)
+		}
+	}
+}
+
+func TestTransitionErrorMessage(t *testing.T) {
+	_, err := Transition(StateDeclined, ActionAccept, false)
+	if err.Error() != "Can't accept a proposal that's declined" {
+		t.Fatalf("Unexpected message %q", err.Error())
+	}
+}
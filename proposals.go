@@ -0,0 +1,517 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"github.com/toxicglados/umori-go/pkg/trades"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxTradeItems = 100
+
+type ProposalRequest struct {
+	// Who the proposal is for, counters go back to whoever proposed
+	To string `json:"to"`
+	// Copies from your collection, only the card, finish, condition,
+	// location and quantity are used
+	Give []UpdateRequest `json:"give"`
+	// Copies from theirs
+	Receive []UpdateRequest `json:"receive"`
+	Message string `json:"message"`
+}
+
+// Checks the cards in a ProposalRequest make sense and turns them into items
+func (request ProposalRequest) items() ([]models.TradeItem, error) {
+	if len(request.Give) + len(request.Receive) == 0 {
+		return nil, ErrInvalidProposal
+	}
+	if len(request.Give) + len(request.Receive) > maxTradeItems {
+		return nil, ErrTooManyUpdates
+	}
+
+	var items []models.TradeItem
+	sides := map[string][]UpdateRequest{models.TradeGive: request.Give, models.TradeReceive: request.Receive}
+	for _, direction := range []string{models.TradeGive, models.TradeReceive} {
+		for _, entryRequest := range sides[direction] {
+			err := entryRequest.validate()
+			if err != nil {
+				return nil, err
+			}
+			if entryRequest.Quantity <= 0 {
+				return nil, ErrInvalidProposal
+			}
+
+			items = append(items, models.TradeItem{
+				Direction: direction,
+				CardID: entryRequest.CardID,
+				Finish: entryRequest.Finish,
+				Condition: entryRequest.Condition,
+				LocationID: entryRequest.LocationID,
+				Quantity: entryRequest.Quantity,
+			})
+		}
+	}
+	return items, nil
+}
+
+// The user giving item away and the user getting it
+func tradeParties(proposal models.TradeProposal, item models.TradeItem) (uint, uint) {
+	if item.Direction == models.TradeGive {
+		return proposal.ProposerID, proposal.RecipientID
+	}
+	return proposal.RecipientID, proposal.ProposerID
+}
+
+// The collection entry item is for in userID's collection
+func tradeEntry(userID uint, item models.TradeItem) models.CollectionEntry {
+	return models.CollectionEntry{
+		UserID: userID,
+		CardID: item.CardID,
+		Finish: item.Finish,
+		Condition: item.Condition,
+		LocationID: item.LocationID,
+		Quantity: item.Quantity,
+	}
+}
+
+// A proposal along with the claims decks have on copies it takes
+// from the user looking at it, which accepting it gives up
+type ProposalResult struct {
+	models.TradeProposal
+	Allocations []AffectedAllocation `json:"allocations,omitempty"`
+}
+
+// The entries a proposal takes copies from and how many it takes
+// from each. The same entry can be in a proposal more than once,
+// so what's needed from each is added up.
+func tradeTakes(proposal models.TradeProposal) []models.CollectionEntry {
+	var entries []models.CollectionEntry
+	for _, item := range proposal.Items {
+		giver, _ := tradeParties(proposal, item)
+		entry := tradeEntry(giver, item)
+
+		found := false
+		for i := range entries {
+			if entries[i].UserID == entry.UserID && entries[i].CardID == entry.CardID &&
+			   entries[i].Finish == entry.Finish && entries[i].Condition == entry.Condition &&
+			   entries[i].LocationID == entry.LocationID {
+				entries[i].Quantity += entry.Quantity
+				found = true
+				break
+			}
+		}
+		if !found {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Locks the entries a proposal takes copies from and makes sure
+// there are enough of them
+func checkTradeItems(tx *gorm.DB, proposal models.TradeProposal) error {
+	entries := tradeTakes(proposal)
+	for i := range entries {
+		current, err := lockEntry(tx, &entries[i])
+		if err != nil {
+			return err
+		}
+		if current.Quantity < entries[i].Quantity {
+			return ErrNotEnoughToTrade
+		}
+	}
+	return nil
+}
+
+// The claims decks have on copies proposal takes from userID's
+// collection that there won't be enough copies left for after it.
+// With lock the entries and claims stay locked so the trade can go ahead.
+func tradeClaims(tx *gorm.DB, proposal models.TradeProposal, userID uint, lock bool) ([]AffectedAllocation, error) {
+	affected := []AffectedAllocation{}
+	for _, entry := range tradeTakes(proposal) {
+		if entry.UserID != userID {
+			continue
+		}
+
+		var current models.CollectionEntry
+		var err error
+		if lock {
+			current, err = lockEntry(tx, &entry)
+		} else {
+			current, err = findEntry(tx, &entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+		claims, err := excessClaims(tx, &entry, current.Quantity - entry.Quantity, lock)
+		if err != nil {
+			return nil, err
+		}
+		affected = append(affected, claims...)
+	}
+	return affected, nil
+}
+
+// Moves every item in an accepted proposal from one collection to the other,
+// recording the changes in both histories as one batch. Deck claims on copies
+// that are traded away are given up, the ones actorID gave up are returned.
+func applyTrade(tx *gorm.DB, proposal models.TradeProposal, actorID uint) (uuid.UUID, []AffectedAllocation, error) {
+	batchID := uuid.New()
+	err := checkTradeItems(tx, proposal)
+	if err != nil {
+		return batchID, nil, err
+	}
+
+	var released []AffectedAllocation
+	for _, userID := range []uint{proposal.ProposerID, proposal.RecipientID} {
+		claims, err := tradeClaims(tx, proposal, userID, true)
+		if err == nil {
+			err = releaseClaims(tx, claims)
+		}
+		if err != nil {
+			return batchID, nil, err
+		}
+		if userID == actorID {
+			released = claims
+		}
+	}
+
+	change := models.CollectionChange{ActorID: actorID, Source: models.ChangeSourceTrade, BatchID: &batchID}
+	for _, item := range proposal.Items {
+		giver, receiver := tradeParties(proposal, item)
+		from := tradeEntry(giver, item)
+		from.Quantity = -item.Quantity
+		err = addToCollection(tx, &from, change)
+		if err != nil {
+			return batchID, nil, err
+		}
+
+		to := tradeEntry(receiver, item)
+		to.LocationID = 0
+		err = addToCollection(tx, &to, change)
+		if err != nil {
+			return batchID, nil, err
+		}
+	}
+	return batchID, released, nil
+}
+
+// Checks the giving side of a new proposal has the copies and saves it
+func createProposal(tx *gorm.DB, proposal *models.TradeProposal) error {
+	err := checkTradeItems(tx, *proposal)
+	if err != nil {
+		return err
+	}
+	return tx.Create(proposal).Error
+}
+
+// Finds a proposal userID made or was sent, locking it so
+// two actions on it can't both go through
+func lockProposal(tx *gorm.DB, userID uint, id uint64) (models.TradeProposal, error) {
+	var proposal models.TradeProposal
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+	          Where("id = ?", id).
+	          Where("proposer_id = ? OR recipient_id = ?", userID, userID).
+	          First(&proposal).
+	          Error
+	if err != nil {
+		return proposal, err
+	}
+
+	err = tx.Where("trade_proposal_id = ?", proposal.ID).
+	         Order("id").
+	         Find(&proposal.Items).
+	         Error
+	return proposal, err
+}
+
+// Fills in the usernames of whoever's on each side of the proposals
+func loadProposalUsers(proposals []models.TradeProposal) error {
+	var ids []uint
+	for _, proposal := range proposals {
+		ids = append(ids, proposal.ProposerID, proposal.RecipientID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var users []models.User
+	err := db.Model(&models.User{}).
+	          Select("id", "username").
+	          Where("id IN ?", ids).
+	          Find(&users).
+	          Error
+	if err != nil {
+		return err
+	}
+
+	usernames := make(map[uint]string)
+	for _, user := range users {
+		usernames[user.ID] = user.Username
+	}
+	for i := range proposals {
+		proposals[i].Proposer = usernames[proposals[i].ProposerID]
+		proposals[i].Recipient = usernames[proposals[i].RecipientID]
+	}
+	return nil
+}
+
+// Writes the error response for a proposal that couldn't be made or acted on
+func writeProposalError(c *gin.Context, err error) {
+	var transitionErr trades.TransitionError
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrProposalNotFound.Error()})
+	} else if errors.Is(err, ErrNotTrading) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrNotTrading.Error()})
+	} else if errors.Is(err, trades.ErrUnknownAction) || errors.Is(err, ErrInvalidProposal) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	} else if errors.Is(err, trades.ErrNotRecipient) || errors.Is(err, trades.ErrNotProposer) {
+		c.JSON(http.StatusForbidden, ErrorResponse{Message: err.Error()})
+	} else if errors.As(err, &transitionErr) {
+		c.JSON(http.StatusConflict, ErrorResponse{Message: err.Error()})
+	} else if errors.Is(err, ErrNotEnoughToTrade) {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Message: ErrNotEnoughToTrade.Error()})
+	} else {
+		log.Printf("Got unexpected error with trade proposal: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+	}
+}
+
+// Writes out a proposal along with who's on each side of it
+// and the deck claims it affects
+func writeProposal(c *gin.Context, status int, proposal models.TradeProposal, allocations []AffectedAllocation) {
+	proposals := []models.TradeProposal{proposal}
+	err := loadProposalUsers(proposals)
+	if err != nil {
+		log.Printf("Got unexpected error finding proposal users: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	c.JSON(status, ProposalResult{TradeProposal: proposals[0], Allocations: allocations})
+}
+
+// Lists the proposals a user has made or been sent, newest first,
+// optionally only those in the state given by "state"
+func tradeProposalsEndpoint(c *gin.Context) {
+	state := c.Query("state")
+	if state != "" && !trades.IsState(state) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrUnknownProposalState.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	query := db.Where("proposer_id = ? OR recipient_id = ?", user.ID, user.ID)
+	if state != "" {
+		query = query.Where("state = ?", state)
+	}
+
+	proposals := []models.TradeProposal{}
+	err = query.Preload("Items").
+	            Order("id desc").
+	            Find(&proposals).
+	            Error
+	if err == nil {
+		err = loadProposalUsers(proposals)
+	}
+	if err != nil {
+		log.Printf("Got unexpected error finding trade proposals: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, proposals)
+}
+
+func tradeProposalEndpoint(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrProposalNotFound.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	var proposal models.TradeProposal
+	err = db.Where("id = ?", id).
+	         Where("proposer_id = ? OR recipient_id = ?", user.ID, user.ID).
+	         Preload("Items").
+	         First(&proposal).
+	         Error
+	if err != nil {
+		writeProposalError(c, err)
+		return
+	}
+
+	// Only pending proposals can still take anything. This is just
+	// a preview, so nothing is locked the way accepting it would.
+	var allocations []AffectedAllocation
+	if proposal.State == trades.StatePending {
+		allocations, err = tradeClaims(db, proposal, user.ID, false)
+		if err != nil {
+			writeProposalError(c, err)
+			return
+		}
+	}
+
+	writeProposal(c, http.StatusOK, proposal, allocations)
+}
+
+// Proposes a trade to another user who's opted in to trading
+func createTradeProposalEndpoint(c *gin.Context) {
+	var request ProposalRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+	items, err := request.items()
+	if err == nil && request.To == "" {
+		err = ErrInvalidProposal
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	var recipients []uint
+	err = db.Model(&models.TradeSettings{}).
+	         Joins("JOIN users ON users.id = trade_settings.user_id").
+	         Where("trade_settings.opt_in = ?", true).
+	         Where("users.username = ?", request.To).
+	         Limit(1).
+	         Pluck("users.id", &recipients).
+	         Error
+	if err == nil && len(recipients) == 0 {
+		err = ErrNotTrading
+	}
+	if err == nil && recipients[0] == user.ID {
+		err = ErrInvalidProposal
+	}
+	if err != nil {
+		writeProposalError(c, err)
+		return
+	}
+
+	proposal := models.TradeProposal{
+		ProposerID: user.ID,
+		RecipientID: recipients[0],
+		State: trades.StatePending,
+		Message: request.Message,
+		Items: items,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return createProposal(tx, &proposal)
+	})
+	if err != nil {
+		writeProposalError(c, err)
+		return
+	}
+
+	writeProposal(c, http.StatusCreated, proposal, nil)
+}
+
+// Accepts, declines, counters or cancels a proposal. Accepting swaps
+// the cards between the collections and lists the deck claims it gave
+// up, countering sends a new proposal from the body back to whoever made this one.
+func tradeProposalActionEndpoint(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrProposalNotFound.Error()})
+		return
+	}
+	action := c.Param("action")
+
+	var counterItems []models.TradeItem
+	var request ProposalRequest
+	if action == trades.ActionCounter {
+		err = c.ShouldBindJSON(&request)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+			return
+		}
+		counterItems, err = request.items()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+			return
+		}
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	var proposal, counter models.TradeProposal
+	var released []AffectedAllocation
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		proposal, err = lockProposal(tx, user.ID, id)
+		if err != nil {
+			return err
+		}
+
+		proposal.State, err = trades.Transition(proposal.State, action, proposal.ProposerID == user.ID)
+		if err != nil {
+			return err
+		}
+
+		if action == trades.ActionAccept {
+			var batchID uuid.UUID
+			batchID, released, err = applyTrade(tx, proposal, user.ID)
+			if err != nil {
+				return err
+			}
+			proposal.BatchID = &batchID
+		} else if action == trades.ActionCounter {
+			counter = models.TradeProposal{
+				ProposerID: user.ID,
+				RecipientID: proposal.ProposerID,
+				State: trades.StatePending,
+				Message: request.Message,
+				CounterOfID: &proposal.ID,
+				Items: counterItems,
+			}
+			err = createProposal(tx, &counter)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&models.TradeProposal{ID: proposal.ID}).
+		          Updates(map[string]interface{}{"state": proposal.State, "batch_id": proposal.BatchID}).
+		          Error
+	})
+	if err != nil {
+		writeProposalError(c, err)
+		return
+	}
+
+	if action == trades.ActionCounter {
+		writeProposal(c, http.StatusCreated, counter, nil)
+		return
+	}
+	writeProposal(c, http.StatusOK, proposal, released)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+)
+
+type SetsResult struct {
+	PagedResult
+	Sets []models.Set `json:"results"`
+}
+
+type SetResult struct {
+	PagedResult
+	Set models.Set `json:"set"`
+	Cards []models.Card `json:"results"`
+}
+
+func setsScope(setType string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		result := db.Model(&models.Set{})
+		if setType != "" {
+			result = result.Where("type = ?", setType)
+		}
+		return result
+	}
+}
+
+func setsEndpoint(c *gin.Context) {
+	setType := c.Query("type")
+	ascending := c.Query("ascending") == "true"
+
+	// Newest sets first unless they ask otherwise
+	order := "release_date desc"
+	if ascending {
+		order = "release_date asc"
+	}
+
+	var count int64
+	err := db.Scopes(setsScope(setType)).
+	          Count(&count).
+	          Error
+	if err != nil {
+		log.Printf("Got unexpected error counting sets: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	var sets []models.Set
+	err = db.Scopes(setsScope(setType)).
+	         Order(order).
+	         Order("name").
+	         Scopes(Paginate(c)).
+	         Find(&sets).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding sets: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	offset, exists := c.Get("offset")
+	if !exists {
+		log.Fatal(errors.New("Couldn't find offset in context"))
+	}
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.JSON(http.StatusOK, SetsResult{
+		PagedResult: NewPagedResult(count, offset.(int64)),
+		Sets: sets,
+	})
+}
+
+func setEndpoint(c *gin.Context) {
+	code := strings.ToLower(c.Param("code"))
+	defaultOnly := c.Query("defaultOnly") == "true"
+
+	var set models.Set
+	err := db.Model(&models.Set{}).
+	          Where("code = ?", code).
+	          First(&set).
+	          Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrSetNotFound.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error finding set: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	cardsInSet := func(db *gorm.DB) *gorm.DB {
+		result := db.Model(&models.Card{}).
+		             Where("set_id = ?", set.ID)
+		if defaultOnly {
+			result = result.Where("default_lang = true")
+		}
+		return result
+	}
+
+	var count int64
+	err = db.Scopes(cardsInSet).
+	         Count(&count).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error counting cards in set: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	var cards []models.Card
+	err = db.Scopes(cardsInSet).
+	         Preload("Set").
+	         Preload("Finishes").
+	         Preload("Faces").
+	         Preload("Legalities").
+	         Order(collectorNumberOrder).
+	         Order("collector_number").
+	         Order("default_lang desc").
+	         Order("language").
+	         Scopes(Paginate(c)).
+	         Find(&cards).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding cards in set: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	offset, exists := c.Get("offset")
+	if !exists {
+		log.Fatal(errors.New("Couldn't find offset in context"))
+	}
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.JSON(http.StatusOK, SetResult{
+		PagedResult: NewPagedResult(count, offset.(int64)),
+		Set: set,
+		Cards: cards,
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxTagLength = 50
+	maxTagEntries = 1000
+)
+
+type TagRequest struct {
+	// Which entries to tag, only the card, finish, condition and location are used
+	Entries []UpdateRequest `json:"entries"`
+	Tags []string `json:"tags"`
+}
+
+// A tag along with how many entries and copies it's on
+type TagSummary struct {
+	Name string `json:"name"`
+	Entries int `json:"entries"`
+	Quantity int `json:"quantity"`
+}
+
+type TagResult struct {
+	// How many tags were added or removed
+	Changed int64 `json:"changed"`
+	Errors []BatchError `json:"errors"`
+}
+
+// Tags are compared case insensitively, so "For-Trade" and "for-trade" are the same
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len(tag) > maxTagLength {
+		return "", ErrInvalidTag
+	}
+	return tag, nil
+}
+
+// Narrows userCollection down to entries with a tag, if there is one
+func withTag(tag string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if tag == "" {
+			return db
+		}
+		return db.Where(`EXISTS (
+		                   SELECT 1 FROM entry_tags
+		                   WHERE entry_tags.collection_entry_id = collection_entries.id
+		                   AND entry_tags.name = ?
+		                 )`, strings.ToLower(strings.TrimSpace(tag)))
+	}
+}
+
+// Reads the location_id and tag query parameters collection listings
+// and exports can be filtered by
+func collectionFilter(c *gin.Context) (func(db *gorm.DB) *gorm.DB, error) {
+	location, err := locationQuery(c)
+	if err != nil {
+		return nil, err
+	}
+	tag := c.Query("tag")
+
+	return func(db *gorm.DB) *gorm.DB {
+		return withTag(tag)(inLocation(location)(db))
+	}, nil
+}
+
+// Lists the tags a user has used along with how many entries have each
+func tagsEndpoint(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	tags := []TagSummary{}
+	err = db.Model(&models.EntryTag{}).
+	         Select("entry_tags.name, COUNT(*) AS entries, SUM(collection_entries.quantity) AS quantity").
+	         Joins("JOIN collection_entries ON collection_entries.id = entry_tags.collection_entry_id").
+	         Where("entry_tags.user_id = ?", user.ID).
+	         Group("entry_tags.name").
+	         Order("entry_tags.name").
+	         Scan(&tags).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error finding tags: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, tags)
+}
+
+// Reads a TagRequest and finds the IDs of the entries in it. Entries
+// that can't be found are written out as errors and nothing is returned.
+func readTagRequest(c *gin.Context, userID uint) ([]uint, []string, bool) {
+	var request TagRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return nil, nil, false
+	}
+	if len(request.Entries) > maxTagEntries {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrTooManyUpdates.Error()})
+		return nil, nil, false
+	}
+	if len(request.Entries) == 0 || len(request.Tags) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrMissingTags.Error()})
+		return nil, nil, false
+	}
+
+	var tags []string
+	for _, tag := range request.Tags {
+		tag, err = normalizeTag(tag)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+			return nil, nil, false
+		}
+		tags = append(tags, tag)
+	}
+
+	result := TagResult{Errors: []BatchError{}}
+	var ids []uint
+	for i, entryRequest := range request.Entries {
+		err = entryRequest.validate()
+		if err != nil {
+			result.Errors = append(result.Errors, BatchError{Index: i, Message: err.Error()})
+			continue
+		}
+
+		collectionEntry := entryRequest.entry(userID)
+		var found []uint
+		err = db.Model(&models.CollectionEntry{}).
+		         Scopes(sameEntry(&collectionEntry)).
+		         Limit(1).
+		         Pluck("id", &found).
+		         Error
+		if err != nil {
+			log.Printf("Got unexpected error finding collection entry: \"%s\"\n", err.Error())
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+			return nil, nil, false
+		}
+		if len(found) == 0 {
+			result.Errors = append(result.Errors, BatchError{Index: i, Message: ErrEntryNotFound.Error()})
+			continue
+		}
+		ids = append(ids, found[0])
+	}
+	if len(result.Errors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, result)
+		return nil, nil, false
+	}
+
+	return ids, tags, true
+}
+
+// The names of the tags on collectionEntry, if it exists
+func entryTagNames(tx *gorm.DB, collectionEntry *models.CollectionEntry) ([]string, error) {
+	var names []string
+	err := tx.Model(&models.EntryTag{}).
+	          Where("collection_entry_id IN (?)", tx.Model(&models.CollectionEntry{}).
+	                                                 Select("id").
+	                                                 Scopes(sameEntry(collectionEntry))).
+	          Pluck("name", &names).
+	          Error
+	return names, err
+}
+
+// Adds tags to a saved entry, tags it already has are left alone
+func addEntryTags(tx *gorm.DB, collectionEntry *models.CollectionEntry, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	var entryTags []models.EntryTag
+	for _, name := range names {
+		entryTags = append(entryTags, models.EntryTag{UserID: collectionEntry.UserID, CollectionEntryID: collectionEntry.ID, Name: name})
+	}
+	return tx.Omit(clause.Associations).
+	          Clauses(clause.OnConflict{DoNothing: true}).
+	          Create(&entryTags).
+	          Error
+}
+
+// Adds tags to entries, tags they already have are left alone
+func tagCollection(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	ids, tags, ok := readTagRequest(c, user.ID)
+	if !ok {
+		return
+	}
+
+	var entryTags []models.EntryTag
+	for _, id := range ids {
+		for _, tag := range tags {
+			entryTags = append(entryTags, models.EntryTag{UserID: user.ID, CollectionEntryID: id, Name: tag})
+		}
+	}
+
+	result := db.Omit(clause.Associations).
+	             Clauses(clause.OnConflict{DoNothing: true}).
+	             Create(&entryTags)
+	if result.Error != nil {
+		log.Printf("Got unexpected error tagging collection: \"%s\"\n", result.Error.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, TagResult{Changed: result.RowsAffected, Errors: []BatchError{}})
+}
+
+func untagCollection(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	ids, tags, ok := readTagRequest(c, user.ID)
+	if !ok {
+		return
+	}
+
+	result := db.Unscoped().
+	             Where("user_id = ?", user.ID).
+	             Where("collection_entry_id IN ?", ids).
+	             Where("name IN ?", tags).
+	             Delete(&models.EntryTag{})
+	if result.Error != nil {
+		log.Printf("Got unexpected error untagging collection: \"%s\"\n", result.Error.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, TagResult{Changed: result.RowsAffected, Errors: []BatchError{}})
+}
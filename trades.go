@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"github.com/toxicglados/umori-go/pkg/trades"
+)
+
+// Entries with this tag are up for trade however many copies there are
+const tradeTag = "for-trade"
+
+type TradeSettingsRequest struct {
+	OptIn *bool `json:"opt_in"`
+	Keep *int `json:"keep"`
+}
+
+// What two users could trade. Receive is what they have
+// spare that you want, Give is the other way around.
+type TradeMatch struct {
+	Username string `json:"username"`
+	Currency string `json:"currency"`
+	Receive []trades.Offer `json:"receive"`
+	ReceiveValue float64 `json:"receive_value"`
+	Give []trades.Offer `json:"give"`
+	GiveValue float64 `json:"give_value"`
+	// Positive when you'd get more than you give
+	Balance float64 `json:"balance"`
+}
+
+// A trading partner along with their settings
+type trader struct {
+	ID uint
+	Username string
+	Keep int
+}
+
+// A user's trade settings, or the defaults if they've never set any
+func findTradeSettings(userID uint) (models.TradeSettings, error) {
+	var settings []models.TradeSettings
+	err := db.Model(&models.TradeSettings{}).
+	          Where("user_id = ?", userID).
+	          Limit(1).
+	          Find(&settings).
+	          Error
+	if err != nil || len(settings) == 0 {
+		return models.TradeSettings{UserID: userID}, err
+	}
+	return settings[0], nil
+}
+
+// The copies a user would trade away. That's everything tagged for
+// trade plus whatever they own of a printing beyond what they keep.
+func tradeSurplus(userID uint, keep int) ([]trades.Surplus, error) {
+	tagged := `EXISTS (
+	             SELECT 1 FROM entry_tags
+	             WHERE entry_tags.collection_entry_id = collection_entries.id
+	             AND entry_tags.name = '` + tradeTag + `'
+	           )`
+
+	var surplus []trades.Surplus
+	err := db.Scopes(userCollection(userID)).
+	          Select("collection_entries.card_id, cards.oracle_id, collection_entries.finish, " +
+	                 "SUM(CASE WHEN " + tagged + " THEN collection_entries.quantity ELSE 0 END) + " +
+	                 "CASE WHEN ? > 0 THEN GREATEST(SUM(CASE WHEN " + tagged + " THEN 0 ELSE collection_entries.quantity END) - ?, 0) ELSE 0 END AS quantity, " +
+	                 "cards.price_usd, cards.price_usd_foil, cards.price_usd_etched, cards.price_eur, cards.price_eur_foil, cards.price_tix",
+	                 keep, keep).
+	          Group("cards.id, collection_entries.card_id, collection_entries.finish").
+	          Scan(&surplus).
+	          Error
+	if err != nil {
+		return nil, err
+	}
+
+	var trading []trades.Surplus
+	for _, copies := range surplus {
+		if copies.Quantity > 0 {
+			trading = append(trading, copies)
+		}
+	}
+	return trading, nil
+}
+
+// The copies a user still needs to satisfy their wishlist
+func tradeWants(userID uint) ([]trades.Want, error) {
+	statuses, err := wishlistStatuses(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var wants []trades.Want
+	for _, status := range statuses {
+		if !status.Satisfied {
+			wants = append(wants, trades.Want{Item: status.WishlistItem, Quantity: status.Quantity - status.Owned})
+		}
+	}
+	return wants, nil
+}
+
+// Fills in the Card of each offer
+func loadOfferCards(offers []trades.Offer) error {
+	var ids []uuid.UUID
+	for _, offer := range offers {
+		ids = append(ids, offer.CardID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	cards, err := findCardsByID(ids)
+	if err != nil {
+		return err
+	}
+	for i := range offers {
+		offers[i].Card = cards[offers[i].CardID]
+	}
+	return nil
+}
+
+// Works out what someone with mySurplus and myWants could trade with partner
+func matchTraders(mySurplus []trades.Surplus, myWants []trades.Want, partner trader, currency string) (TradeMatch, error) {
+	match := TradeMatch{Username: partner.Username, Currency: currency}
+
+	theirSurplus, err := tradeSurplus(partner.ID, partner.Keep)
+	if err != nil {
+		return match, err
+	}
+	theirWants, err := tradeWants(partner.ID)
+	if err != nil {
+		return match, err
+	}
+
+	match.Receive, match.ReceiveValue = trades.Match(theirSurplus, myWants, currency)
+	match.Give, match.GiveValue = trades.Match(mySurplus, theirWants, currency)
+	match.Balance = match.ReceiveValue - match.GiveValue
+	if match.Receive == nil {
+		match.Receive = []trades.Offer{}
+	}
+	if match.Give == nil {
+		match.Give = []trades.Offer{}
+	}
+
+	err = loadOfferCards(match.Receive)
+	if err == nil {
+		err = loadOfferCards(match.Give)
+	}
+	return match, err
+}
+
+func tradeSettingsEndpoint(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	settings, err := findTradeSettings(user.ID)
+	if err != nil {
+		log.Printf("Got unexpected error finding trade settings: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// Updates whichever trade settings are in the request
+func updateTradeSettingsEndpoint(c *gin.Context) {
+	var request TradeSettingsRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+	if request.Keep != nil && *request.Keep < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrNegativeQuantity.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	settings, err := findTradeSettings(user.ID)
+	if err == nil {
+		if request.OptIn != nil {
+			settings.OptIn = *request.OptIn
+		}
+		if request.Keep != nil {
+			settings.Keep = *request.Keep
+		}
+		err = db.Save(&settings).Error
+	}
+	if err != nil {
+		log.Printf("Got unexpected error updating trade settings: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// Lists what the user could trade with another user, given with
+// "with", or with everyone who's opted in to trading
+func tradeMatchesEndpoint(c *gin.Context) {
+	currency := strings.ToLower(c.DefaultQuery("currency", models.CurrencyUSD))
+	if !models.IsCurrency(currency) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrUnknownCurrency.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	// Only people who've opted in can be matched against
+	partnersQuery := db.Model(&models.TradeSettings{}).
+	                    Select("users.id, users.username, trade_settings.keep").
+	                    Joins("JOIN users ON users.id = trade_settings.user_id").
+	                    Where("trade_settings.opt_in = ?", true).
+	                    Where("users.id <> ?", user.ID).
+	                    Order("users.username")
+	with := c.Query("with")
+	if with != "" {
+		partnersQuery = partnersQuery.Where("users.username = ?", with)
+	}
+
+	var partners []trader
+	err = partnersQuery.Scan(&partners).Error
+	if err == nil && with != "" && len(partners) == 0 {
+		err = ErrNotTrading
+	}
+	if errors.Is(err, ErrNotTrading) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrNotTrading.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Got unexpected error finding trade partners: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	settings, err := findTradeSettings(user.ID)
+	if err != nil {
+		log.Printf("Got unexpected error finding trade settings: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	mySurplus, err := tradeSurplus(user.ID, settings.Keep)
+	if err != nil {
+		log.Printf("Got unexpected error finding trade surplus: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	myWants, err := tradeWants(user.ID)
+	if err != nil {
+		log.Printf("Got unexpected error finding trade wants: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	matches := []TradeMatch{}
+	for _, partner := range partners {
+		match, err := matchTraders(mySurplus, myWants, partner, currency)
+		if err != nil {
+			log.Printf("Got unexpected error matching trades: \"%s\"\n", err.Error())
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+			return
+		}
+		if with != "" || len(match.Receive) > 0 || len(match.Give) > 0 {
+			matches = append(matches, match)
+		}
+	}
+
+	// The people with the most of what you want first
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].ReceiveValue > matches[j].ReceiveValue
+	})
+
+	c.JSON(http.StatusOK, matches)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+	"gorm.io/gorm"
+)
+
+type SetValue struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Value float64 `json:"value"`
+}
+
+type EntryValue struct {
+	CardID uuid.UUID `json:"-"`
+	Card models.Card `json:"card" gorm:"-"`
+	Finish string `json:"finish"`
+	Quantity int `json:"quantity"`
+	Price float64 `json:"price"`
+	Value float64 `json:"value"`
+}
+
+type CollectionValue struct {
+	Currency string `json:"currency"`
+	Total float64 `json:"total"`
+	Sets []SetValue `json:"sets"`
+	Top []EntryValue `json:"top"`
+}
+
+// The SQL for the price of a card in currency, taking the finish
+// of the collection entry it's joined with into account. table
+// is anything with price columns, cards or price_snapshots.
+// Returns false if we don't know the currency.
+func priceExpression(currency, table string) (string, bool) {
+	if !models.IsCurrency(currency) {
+		return "", false
+	}
+
+	return fmt.Sprintf(`
+	CASE collection_entries.finish
+	  WHEN 'foil' THEN %[1]s.%[2]s
+	  WHEN 'etched' THEN %[1]s.%[3]s
+	  ELSE %[1]s.%[4]s
+	END`,
+	table,
+	models.PriceColumn(currency, models.FinishFoil),
+	models.PriceColumn(currency, models.FinishEtched),
+	models.PriceColumn(currency, models.FinishNonfoil)), true
+}
+
+// Works out what a user's collection is worth in total and per set
+// along with the most valuable cards in it
+func collectionValueEndpoint(c *gin.Context) {
+	currency := strings.ToLower(c.DefaultQuery("currency", "usd"))
+	price, ok := priceExpression(currency, "cards")
+	if !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrUnknownCurrency.Error()})
+		return
+	}
+
+	top, err := strconv.Atoi(c.Query("top"))
+	if err != nil || top < 0 {
+		top = topValueSize
+	} else if top > maxTopValueSize {
+		top = maxTopValueSize
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	value := CollectionValue{
+		Currency: currency,
+		Sets: []SetValue{},
+		Top: []EntryValue{},
+	}
+
+	// Cards without a price are counted as worthless
+	err = db.Scopes(userCollection(user.ID), withSets).
+	         Select("sets.code, sets.name, SUM(collection_entries.quantity * COALESCE(" + price + ", 0)) AS value").
+	         Group("sets.code, sets.name").
+	         Order("value desc").
+	         Scan(&value.Sets).
+	         Error
+	if err != nil {
+		log.Printf("Got unexpected error valuing collection: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	for _, set := range value.Sets {
+		value.Total += set.Value
+	}
+
+	if top > 0 {
+		err = db.Scopes(userCollection(user.ID)).
+		         Select("collection_entries.card_id, collection_entries.finish, collection_entries.quantity, " + price + " AS price, collection_entries.quantity * " + price + " AS value").
+		         Where(price + " IS NOT NULL").
+		         Where("collection_entries.quantity > 0").
+		         Order("price desc").
+		         Limit(top).
+		         Scan(&value.Top).
+		         Error
+		if err != nil {
+			log.Printf("Got unexpected error finding most valuable cards: \"%s\"\n", err.Error())
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+			return
+		}
+
+		err = loadEntryCards(value.Top)
+		if err != nil {
+			log.Printf("Got unexpected error loading cards: \"%s\"\n", err.Error())
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, value)
+}
+
+func findCardsByID(ids []uuid.UUID) (map[uuid.UUID]models.Card, error) {
+	var cards []models.Card
+	err := db.Model(&models.Card{}).
+	          Preload("Set").
+	          Where("id IN ?", ids).
+	          Find(&cards).
+	          Error
+	if err != nil {
+		return nil, err
+	}
+
+	cardsByID := make(map[uuid.UUID]models.Card)
+	for _, card := range cards {
+		cardsByID[card.ID] = card
+	}
+
+	return cardsByID, nil
+}
+
+// Fills in the Card of each EntryValue
+func loadEntryCards(entries []EntryValue) error {
+	var ids []uuid.UUID
+	for _, entry := range entries {
+		ids = append(ids, entry.CardID)
+	}
+
+	cardsByID, err := findCardsByID(ids)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].Card = cardsByID[entries[i].CardID]
+	}
+
+	return nil
+}
+
+type PriceMovement struct {
+	CardID uuid.UUID `json:"-"`
+	Card models.Card `json:"card" gorm:"-"`
+	Finish string `json:"finish"`
+	Quantity int `json:"quantity"`
+	PreviousPrice float64 `json:"previous_price"`
+	CurrentPrice float64 `json:"current_price"`
+	// Change in price of a single copy
+	Change float64 `json:"change"`
+	// nil when the card used to be free
+	PercentChange *float64 `json:"percent_change"`
+	// Change in price of every copy the user owns
+	TotalChange float64 `json:"total_change"`
+}
+
+type PriceMovers struct {
+	Currency string `json:"currency"`
+	Days int `json:"days"`
+	Gainers []PriceMovement `json:"gainers"`
+	Losers []PriceMovement `json:"losers"`
+}
+
+// Finds the cards in a user's collection whose value changed the
+// most over the last few days, going by the price snapshots the
+// importer takes
+func collectionMoversEndpoint(c *gin.Context) {
+	currency := strings.ToLower(c.DefaultQuery("currency", "usd"))
+	currentPrice, ok := priceExpression(currency, "cards")
+	if !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrUnknownCurrency.Error()})
+		return
+	}
+	previousPrice, _ := priceExpression(currency, "earlier")
+
+	days, err := strconv.Atoi(c.Query("days"))
+	if err != nil || days <= 0 {
+		days = moversDays
+	} else if days > maxMoversDays {
+		days = maxMoversDays
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = topValueSize
+	} else if limit > maxTopValueSize {
+		limit = maxTopValueSize
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	movers := PriceMovers{
+		Currency: currency,
+		Days: days,
+		Gainers: []PriceMovement{},
+		Losers: []PriceMovement{},
+	}
+
+	// Cards already have the latest prices, we compare them with
+	// the newest snapshot from before the start of the window
+	since := time.Now().AddDate(0, 0, -days)
+	change := "(" + currentPrice + " - " + previousPrice + ")"
+	// This has to be used after userCollection since it needs the cards join
+	movements := func(order string) func(db *gorm.DB) *gorm.DB {
+		return func(db *gorm.DB) *gorm.DB {
+			return db.Joins(`JOIN LATERAL (
+			                   SELECT * FROM price_snapshots
+			                   WHERE price_snapshots.card_id = cards.id AND price_snapshots.date <= ?
+			                   ORDER BY price_snapshots.date DESC
+			                   LIMIT 1
+			                 ) AS earlier ON true`, since).
+			          Select("collection_entries.card_id, collection_entries.finish, collection_entries.quantity, " +
+			                 previousPrice + " AS previous_price, " +
+			                 currentPrice + " AS current_price, " +
+			                 change + " AS change, " +
+			                 "100 * " + change + " / NULLIF(" + previousPrice + ", 0) AS percent_change, " +
+			                 "collection_entries.quantity * " + change + " AS total_change").
+			          Where("collection_entries.quantity > 0").
+			          Order("total_change " + order).
+			          Limit(limit)
+		}
+	}
+
+	err = db.Scopes(userCollection(user.ID), movements("desc")).
+	         Where(change + " > 0").
+	         Scan(&movers.Gainers).
+	         Error
+	if err == nil {
+		err = db.Scopes(userCollection(user.ID), movements("asc")).
+		         Where(change + " < 0").
+		         Scan(&movers.Losers).
+		         Error
+	}
+	if err != nil {
+		log.Printf("Got unexpected error finding price movers: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	var ids []uuid.UUID
+	for _, movement := range append(movers.Gainers, movers.Losers...) {
+		ids = append(ids, movement.CardID)
+	}
+	cardsByID, err := findCardsByID(ids)
+	if err != nil {
+		log.Printf("Got unexpected error loading cards: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	for i := range movers.Gainers {
+		movers.Gainers[i].Card = cardsByID[movers.Gainers[i].CardID]
+	}
+	for i := range movers.Losers {
+		movers.Losers[i].Card = cardsByID[movers.Losers[i].CardID]
+	}
+
+	c.JSON(http.StatusOK, movers)
+}
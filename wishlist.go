@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/toxicglados/umori-go/pkg/models"
+)
+
+// How many copies of a wishlist item's card are in the collection.
+// Oracle items count every printing, items without a finish count every finish.
+const wishlistOwned = `COALESCE((
+	SELECT SUM(collection_entries.quantity)
+	FROM collection_entries
+	JOIN cards ON cards.id = collection_entries.card_id
+	WHERE collection_entries.user_id = wishlist_items.user_id
+	AND (collection_entries.card_id = wishlist_items.card_id OR cards.oracle_id = wishlist_items.oracle_id)
+	AND (wishlist_items.finish = '' OR collection_entries.finish = wishlist_items.finish)
+), 0)`
+
+type WishlistRequest struct {
+	CardID *uuid.UUID `json:"card_id"`
+	OracleID *uuid.UUID `json:"oracle_id"`
+	// Defaults to 1
+	Quantity int `json:"quantity"`
+	// Any finish will do when empty
+	Finish string `json:"finish"`
+	// Defaults to usd
+	Currency string `json:"currency"`
+	MaxPrice *float64 `json:"max_price"`
+}
+
+// A wishlist item and how close the collection is to satisfying it
+type WishlistStatus struct {
+	models.WishlistItem
+	Owned int `json:"owned"`
+	Satisfied bool `json:"satisfied" gorm:"-"`
+}
+
+// Checks a WishlistRequest makes sense and turns it into an item for userID
+func (request WishlistRequest) item(userID uint) (models.WishlistItem, error) {
+	if (request.CardID == nil) == (request.OracleID == nil) {
+		return models.WishlistItem{}, ErrInvalidWishlistCard
+	}
+	if request.Quantity < 0 || (request.MaxPrice != nil && *request.MaxPrice <= 0) {
+		return models.WishlistItem{}, ErrInvalidWishlistItem
+	}
+
+	item := models.WishlistItem{
+		UserID: userID,
+		CardID: request.CardID,
+		OracleID: request.OracleID,
+		Quantity: request.Quantity,
+		Finish: request.Finish,
+		Currency: strings.ToLower(request.Currency),
+		MaxPrice: request.MaxPrice,
+	}
+
+	if item.Quantity == 0 {
+		item.Quantity = 1
+	}
+	if item.Finish != "" && !models.IsFinish(item.Finish) {
+		return models.WishlistItem{}, ErrUnknownFinish
+	}
+	if item.Currency == "" {
+		item.Currency = models.CurrencyUSD
+	} else if !models.IsCurrency(item.Currency) {
+		return models.WishlistItem{}, ErrUnknownCurrency
+	}
+
+	return item, nil
+}
+
+// Every item on a user's wishlist along with how many they own
+func wishlistStatuses(userID uint) ([]WishlistStatus, error) {
+	statuses := []WishlistStatus{}
+	err := db.Model(&models.WishlistItem{}).
+	          Select("wishlist_items.*, " + wishlistOwned + " AS owned").
+	          Where("wishlist_items.user_id = ?", userID).
+	          Order("wishlist_items.id").
+	          Scan(&statuses).
+	          Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range statuses {
+		statuses[i].Satisfied = statuses[i].Owned >= statuses[i].Quantity
+	}
+	return statuses, nil
+}
+
+func wishlistEndpoint(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	statuses, err := wishlistStatuses(user.ID)
+	if err != nil {
+		log.Printf("Got unexpected error finding wishlist: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, statuses)
+}
+
+// The wishlist items the collection now has enough copies for,
+// so they can be crossed off
+func wishlistSatisfiedEndpoint(c *gin.Context) {
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	statuses, err := wishlistStatuses(user.ID)
+	if err != nil {
+		log.Printf("Got unexpected error finding wishlist: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	satisfied := []WishlistStatus{}
+	for _, status := range statuses {
+		if status.Satisfied {
+			satisfied = append(satisfied, status)
+		}
+	}
+
+	c.JSON(http.StatusOK, satisfied)
+}
+
+func createWishlistItemEndpoint(c *gin.Context) {
+	var request WishlistRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: ErrInvalidJSON.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	item, err := request.item(user.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	// Make sure whatever they want actually exists
+	var count int64
+	if item.CardID != nil {
+		err = db.Model(&models.Card{}).Where("id = ?", *item.CardID).Count(&count).Error
+	} else {
+		err = db.Model(&models.OracleCard{}).Where("id = ?", *item.OracleID).Count(&count).Error
+	}
+	if err != nil {
+		log.Printf("Got unexpected error finding card: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrCardNotFound.Error()})
+		return
+	}
+
+	err = db.Create(&item).Error
+	if err != nil {
+		log.Printf("Got unexpected error creating wishlist item: \"%s\"\n", err.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, item)
+}
+
+func deleteWishlistItemEndpoint(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrWishlistItemNotFound.Error()})
+		return
+	}
+
+	user, err := findUser(c.Param("user"))
+	if err != nil {
+		writeFindUserError(c, err)
+		return
+	}
+
+	result := db.Where("id = ?", id).
+	             Where("user_id = ?", user.ID).
+	             Delete(&models.WishlistItem{})
+	if result.Error != nil {
+		log.Printf("Got unexpected error deleting wishlist item: \"%s\"\n", result.Error.Error())
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Message: ErrUnknown.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{Message: ErrWishlistItemNotFound.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}